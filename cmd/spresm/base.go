@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// The output of the last evaluation, before any local edits, is kept
+// in the state directory so it can be used as the base for merging
+// when updating; otherwise, the previous version of the spec would
+// have to be evaluated again, which is slow and relies on the
+// previous version still being available.
+var (
+	baseDir = filepath.Join(stateDir, "base")
+	// where the next base is written, until it can be recorded
+	nextBaseDir = filepath.Join(stateDir, "base.next")
+)
+
+// stageBase writes the resources given, ready to be recorded as the
+// base for the next update by commitBase. The base must only be
+// recorded once the package files have been written; otherwise, if
+// writing them failed, the next update would take the changes as
+// already merged. The resources are written before the package files
+// are, since writing those clears the annotations saying which file
+// each resource belongs in.
+func stageBase(dir string, generated []*yaml.RNode) error {
+	if err := writeSnapshot(filepath.Join(dir, nextBaseDir), generated); err != nil {
+		return fmt.Errorf("could not write generated resources to %s: %w", nextBaseDir, err)
+	}
+	return nil
+}
+
+// commitBase records the resources written by stageBase as the base
+// for the next update.
+func commitBase(dir string) error {
+	if err := os.RemoveAll(filepath.Join(dir, baseDir)); err != nil {
+		return fmt.Errorf("could not remove previous base: %w", err)
+	}
+	if err := os.Rename(filepath.Join(dir, nextBaseDir), filepath.Join(dir, baseDir)); err != nil {
+		return fmt.Errorf("could not record generated resources in %s: %w", baseDir, err)
+	}
+	return nil
+}
+
+// readBase reads the resources recorded as the base for merging. If
+// there are none recorded, it returns an error satisfying
+// os.IsNotExist.
+func readBase(dir string) ([]*yaml.RNode, error) {
+	path := filepath.Join(dir, baseDir)
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	nodes, err := readSnapshot(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read generated resources recorded in %s: %w", baseDir, err)
+	}
+	return nodes, nil
+}
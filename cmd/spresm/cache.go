@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/squaremo/spresm/pkg/eval"
+)
+
+func newCacheCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: `inspect or prune the cache of chart repository indexes and archives`,
+	}
+	list := &cobra.Command{
+		Use:   "list",
+		Short: `list what's in the cache`,
+		RunE:  runCacheList,
+	}
+	pruneFlags := &cachePruneFlags{}
+	prune := &cobra.Command{
+		Use:   "prune",
+		Short: `remove entries from the cache that haven't been used recently`,
+		RunE:  pruneFlags.run,
+	}
+	pruneFlags.init(prune)
+	cmd.AddCommand(list, prune)
+	return cmd
+}
+
+var errNoCache = errors.New("the cache is disabled")
+
+func runCacheList(cmd *cobra.Command, args []string) error {
+	if eval.ChartCache == nil {
+		return errNoCache
+	}
+	entries, err := eval.ChartCache.List()
+	if err != nil {
+		return err
+	}
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "KIND\tKEY\tSIZE\tLAST USED\tURLS")
+	for _, e := range entries {
+		fmt.Fprintf(out, "%s\t%s\t%d\t%s\t%s\n", e.Kind, e.Key, e.Size, e.ModTime.Format(time.RFC3339), strings.Join(e.URLs, ","))
+	}
+	return out.Flush()
+}
+
+type cachePruneFlags struct {
+	olderThan time.Duration
+	all       bool
+}
+
+func (flags *cachePruneFlags) init(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&flags.olderThan, "older-than", 30*24*time.Hour, "remove entries not used for at least this long")
+	cmd.Flags().BoolVar(&flags.all, "all", false, "remove everything from the cache")
+}
+
+func (flags *cachePruneFlags) run(cmd *cobra.Command, args []string) error {
+	if eval.ChartCache == nil {
+		return errNoCache
+	}
+	before := time.Now().Add(-flags.olderThan)
+	if flags.all {
+		before = time.Now().Add(time.Second)
+	}
+	pruned, err := eval.ChartCache.Prune(before)
+	for _, e := range pruned {
+		fmt.Printf("removed %s %s\n", e.Kind, e.Key)
+	}
+	return err
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/squaremo/spresm/pkg/merge"
+)
+
+// When an update results in conflicts, the package directory is
+// left with the non-conflicting resources merged, and a record of
+// the update in progress kept in the state directory (akin to git's
+// MERGE_HEAD). This holds
+//
+//  - the spec file and lock file as they were before the update;
+//  - the resources as they were before the update, in orig/;
+//  - the newly generated resources, in base/, which become the
+//    base for merging once the update is finished;
+//  - a list of the conflicts that are yet to be resolved.
+//
+// Each conflicting resource also gets the versions from each side of
+// the merge written to a file next to where it belongs, e.g.,
+// deployment.yaml.spresm-conflict.
+
+const conflictSuffix = ".spresm-conflict"
+
+var (
+	mergeStateDir  = filepath.Join(stateDir, "merge")
+	mergeStateFile = filepath.Join(mergeStateDir, "state.yaml")
+	mergeOrigDir   = filepath.Join(mergeStateDir, "orig")
+	mergeBaseDir   = filepath.Join(mergeStateDir, "base")
+	mergeOrigSpec  = filepath.Join(mergeStateDir, Spresmfile)
+	mergeOrigLock  = filepath.Join(mergeStateDir, Lockfile)
+
+	errNoMergeState = errors.New("there is no update in progress")
+	errUnresolved   = errors.New("there are unresolved conflicts")
+)
+
+// mergeState is the record of an update in progress.
+type mergeState struct {
+	Conflicts []conflictRecord `yaml:"conflicts"`
+}
+
+// conflictRecord is the record of a single unresolved conflict.
+type conflictRecord struct {
+	Resource yaml.ResourceIdentifier `yaml:"resource"`
+	Class    merge.ConflictClass     `yaml:"class"`
+	// the file the resource belongs in, relative to the package
+	// directory
+	Path string `yaml:"path"`
+	// for documents that aren't resources, the position in the
+	// file, which identifies it along with the path
+	Index string `yaml:"index,omitempty"`
+}
+
+func (r conflictRecord) String() string {
+	return merge.Conflict{Identifier: r.Resource, Path: r.Path, Index: r.Index, Class: r.Class}.String()
+}
+
+// conflictDoc is the form of each document in a conflict file.
+type conflictDoc struct {
+	Conflict string                  `yaml:"conflict"`
+	Resource yaml.ResourceIdentifier `yaml:"resource"`
+	Index    string                  `yaml:"index,omitempty"`
+	Mine     *yaml.Node              `yaml:"mine"`
+	Orig     *yaml.Node              `yaml:"orig"`
+	Yours    *yaml.Node              `yaml:"yours"`
+}
+
+// saveMergeState records an update in progress, given the resources
+// as they were before the update, the newly generated resources, and
+// the conflicts resulting from the merge. This must be called before
+// the merged resources or the updated spec are written to the
+// package directory.
+func saveMergeState(dir string, before, generated []*yaml.RNode, conflicts []merge.Conflict) error {
+	if err := os.MkdirAll(filepath.Join(dir, mergeStateDir), os.FileMode(0700)); err != nil {
+		return fmt.Errorf("could not create directory for update state: %w", err)
+	}
+
+	if err := copyFile(filepath.Join(dir, Spresmfile), filepath.Join(dir, mergeOrigSpec)); err != nil {
+		return fmt.Errorf("could not save spec file in update state: %w", err)
+	}
+	// there may not be a lock file, in which case there's nothing to
+	// save.
+	if err := copyFile(filepath.Join(dir, Lockfile), filepath.Join(dir, mergeOrigLock)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not save lock file in update state: %w", err)
+	}
+
+	if err := writeSnapshot(filepath.Join(dir, mergeOrigDir), before); err != nil {
+		return fmt.Errorf("could not save resources in update state: %w", err)
+	}
+	if err := writeSnapshot(filepath.Join(dir, mergeBaseDir), generated); err != nil {
+		return fmt.Errorf("could not save generated resources in update state: %w", err)
+	}
+
+	state := &mergeState{}
+	docs := map[string][]conflictDoc{}
+	for _, c := range conflicts {
+		doc := conflictDoc{
+			Conflict: c.String(),
+			Resource: c.Identifier,
+			Index:    c.Index,
+		}
+		var path string
+		for _, side := range []struct {
+			node *yaml.RNode
+			dest **yaml.Node
+		}{
+			{c.Mine, &doc.Mine},
+			{c.Orig, &doc.Orig},
+			{c.Yours, &doc.Yours},
+		} {
+			if side.node == nil {
+				continue
+			}
+			// Prefer where the resource is locally, then where it
+			// was, then where it would be generated.
+			if p, _, err := kioutil.GetFileAnnotations(side.node); err == nil && path == "" {
+				path = p
+			}
+			stripped, err := stripFileAnnotations(side.node)
+			if err != nil {
+				return err
+			}
+			*side.dest = stripped.YNode()
+		}
+		if path == "" {
+			path = kioutil.CreatePathAnnotationValue("", yaml.ResourceMeta{
+				TypeMeta:   c.Identifier.TypeMeta,
+				ObjectMeta: yaml.ObjectMeta{NameMeta: c.Identifier.NameMeta},
+			})
+		}
+		state.Conflicts = append(state.Conflicts, conflictRecord{
+			Resource: c.Identifier,
+			Class:    c.Class,
+			Path:     path,
+			Index:    c.Index,
+		})
+		docs[path] = append(docs[path], doc)
+	}
+
+	for path, pathDocs := range docs {
+		if err := writeConflictFile(dir, path, pathDocs); err != nil {
+			return err
+		}
+	}
+	return writeMergeState(dir, state)
+}
+
+func writeMergeState(dir string, state *mergeState) error {
+	buf := &bytes.Buffer{}
+	err := yaml.NewEncoder(buf).Encode(state)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, mergeStateFile), buf.Bytes(), os.FileMode(0600))
+	}
+	if err != nil {
+		return fmt.Errorf("could not write update state: %w", err)
+	}
+	return nil
+}
+
+// loadMergeState reads the record of an update in progress; if
+// there is none, it returns errNoMergeState.
+func loadMergeState(dir string) (*mergeState, error) {
+	f, err := os.Open(filepath.Join(dir, mergeStateFile))
+	if os.IsNotExist(err) {
+		return nil, errNoMergeState
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read update state: %w", err)
+	}
+	defer f.Close()
+	state := &mergeState{}
+	if err := yaml.NewDecoder(f).Decode(state); err != nil {
+		return nil, fmt.Errorf("could not decode update state: %w", err)
+	}
+	return state, nil
+}
+
+// clearMergeState removes the record of an update in progress, and
+// any conflict files left over.
+func clearMergeState(dir string, state *mergeState) error {
+	for _, c := range state.Conflicts {
+		err := os.Remove(filepath.Join(dir, c.Path+conflictSuffix))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove conflict file: %w", err)
+		}
+	}
+	if err := os.RemoveAll(filepath.Join(dir, mergeStateDir)); err != nil {
+		return fmt.Errorf("could not remove update state: %w", err)
+	}
+	// this will fail if there's anything else in there, which is
+	// fine.
+	os.Remove(filepath.Join(dir, stateDir))
+	return nil
+}
+
+func writeConflictFile(dir, path string, docs []conflictDoc) error {
+	conflictPath := filepath.Join(dir, path+conflictSuffix)
+	if len(docs) == 0 {
+		if err := os.Remove(conflictPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove conflict file %s: %w", conflictPath, err)
+		}
+		return nil
+	}
+	buf := &bytes.Buffer{}
+	enc := yaml.NewEncoder(buf)
+	for _, doc := range docs {
+		if err := enc.Encode(doc); err != nil {
+			return fmt.Errorf("could not encode conflict for %s: %w", merge.FormatIdentifier(doc.Resource), err)
+		}
+	}
+	enc.Close()
+	if err := os.MkdirAll(filepath.Dir(conflictPath), os.FileMode(0700)); err != nil {
+		return fmt.Errorf("could not create directory for conflict file %s: %w", conflictPath, err)
+	}
+	if err := ioutil.WriteFile(conflictPath, buf.Bytes(), os.FileMode(0600)); err != nil {
+		return fmt.Errorf("could not write conflict file %s: %w", conflictPath, err)
+	}
+	return nil
+}
+
+func readConflictFile(dir, path string) ([]conflictDoc, error) {
+	conflictPath := filepath.Join(dir, path+conflictSuffix)
+	f, err := os.Open(conflictPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not open conflict file: %w", err)
+	}
+	defer f.Close()
+	var docs []conflictDoc
+	dec := yaml.NewDecoder(f)
+	for {
+		// The versions of the resource are decoded as nodes, which
+		// can't be done directly into the fields of a struct; so,
+		// decode the document as a node and pick it apart.
+		var node yaml.Node
+		err := dec.Decode(&node)
+		if err == io.EOF {
+			break
+		}
+		var doc conflictDoc
+		if err == nil {
+			err = node.Decode(&struct {
+				Conflict *string                  `yaml:"conflict"`
+				Resource *yaml.ResourceIdentifier `yaml:"resource"`
+				Index    *string                  `yaml:"index"`
+			}{&doc.Conflict, &doc.Resource, &doc.Index})
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not decode conflict file %s: %w", conflictPath, err)
+		}
+		rn := yaml.NewRNode(&node)
+		for field, dest := range map[string]**yaml.Node{
+			"mine":  &doc.Mine,
+			"orig":  &doc.Orig,
+			"yours": &doc.Yours,
+		} {
+			if version, err := rn.Pipe(yaml.Lookup(field)); err == nil && version != nil {
+				*dest = version.YNode()
+			}
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// findConflict looks for the unresolved conflict referred to by
+// `ref`, which is either <kind>/<name>, <kind>/<namespace>/<name>,
+// or the path of a file with only one conflicting resource in it.
+func (state *mergeState) findConflict(ref string) (int, error) {
+	var found []int
+	parts := strings.Split(ref, "/")
+	for i, c := range state.Conflicts {
+		id := c.Resource
+		switch {
+		case filepath.Clean(ref) == filepath.Clean(c.Path):
+		case len(parts) == 2 && strings.EqualFold(parts[0], id.Kind) && parts[1] == id.Name:
+		case len(parts) == 3 && strings.EqualFold(parts[0], id.Kind) && parts[1] == id.Namespace && parts[2] == id.Name:
+		default:
+			continue
+		}
+		found = append(found, i)
+	}
+	switch len(found) {
+	case 0:
+		return -1, fmt.Errorf("no unresolved conflict matches %q", ref)
+	case 1:
+		return found[0], nil
+	default:
+		return -1, fmt.Errorf("%q matches more than one conflict; use <kind>/<namespace>/<name> to pick one", ref)
+	}
+}
+
+// continueUpdate finishes an update that had conflicts, once they are
+// all resolved.
+func continueUpdate(dir string) error {
+	state, err := loadMergeState(dir)
+	if err != nil {
+		return err
+	}
+	if len(state.Conflicts) > 0 {
+		reportUnresolved(state)
+		return errUnresolved
+	}
+	// the generated resources become the base for the next update
+	if err := os.RemoveAll(filepath.Join(dir, baseDir)); err != nil {
+		return fmt.Errorf("could not remove previous base: %w", err)
+	}
+	if err := os.Rename(filepath.Join(dir, mergeBaseDir), filepath.Join(dir, baseDir)); err != nil {
+		return fmt.Errorf("could not record generated resources in %s: %w", baseDir, err)
+	}
+	if err := clearMergeState(dir, state); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Update of %s completed\n", dir)
+	return nil
+}
+
+// abortUpdate restores the package directory to how it was before an
+// update that had conflicts.
+func abortUpdate(dir string) error {
+	state, err := loadMergeState(dir)
+	if err != nil {
+		return err
+	}
+
+	before, err := readSnapshot(filepath.Join(dir, mergeOrigDir))
+	if err != nil {
+		return fmt.Errorf("could not read resources saved in update state: %w", err)
+	}
+	rw, err := packageFor(dir)
+	if err != nil {
+		return err
+	}
+	if _, err := rw.Read(); err != nil {
+		return fmt.Errorf("could not parse local files: %w", err)
+	}
+	if err := rw.Write(before); err != nil {
+		return fmt.Errorf("failed to restore files in %s: %w", dir, err)
+	}
+
+	if err := copyFile(filepath.Join(dir, mergeOrigSpec), filepath.Join(dir, Spresmfile)); err != nil {
+		return fmt.Errorf("failed to restore spec file: %w", err)
+	}
+	// if there was no lock file before, there shouldn't be one after
+	err = copyFile(filepath.Join(dir, mergeOrigLock), filepath.Join(dir, Lockfile))
+	if os.IsNotExist(err) {
+		err = os.Remove(filepath.Join(dir, Lockfile))
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to restore lock file: %w", err)
+	}
+
+	if err := clearMergeState(dir, state); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Update of %s aborted; files restored\n", dir)
+	return nil
+}
+
+// copyFile copies the file at `from` to `to`, along with its
+// permissions. If `from` does not exist, the error will satisfy
+// os.IsNotExist.
+func copyFile(from, to string) error {
+	info, err := os.Stat(from)
+	if err != nil {
+		return err
+	}
+	bytes, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(to, bytes, info.Mode().Perm()); err != nil {
+		return err
+	}
+	// WriteFile leaves the permissions of an existing file alone
+	return os.Chmod(to, info.Mode().Perm())
+}
+
+func reportUnresolved(state *mergeState) {
+	fmt.Fprintf(os.Stderr, "Unresolved conflicts:\n")
+	for _, c := range state.Conflicts {
+		fmt.Fprintf(os.Stderr, "  %s (see %s)\n", c, c.Path+conflictSuffix)
+	}
+	fmt.Fprintf(os.Stderr, `
+Edit the files and use 'spresm resolve <dir> <resource>' to mark
+each as resolved, or 'spresm resolve <dir> --ours|--theirs <resource>'
+to pick a side. Then use 'spresm update --continue <dir>' to finish
+the update, or 'spresm update --abort <dir>' to give up on it.
+`)
+}
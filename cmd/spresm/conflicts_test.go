@@ -0,0 +1,347 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/squaremo/spresm/pkg/merge"
+)
+
+// writeFiles writes the files given, by path, into a temporary
+// directory, and returns the directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "spresm-cmd-test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	return root
+}
+
+func readFile(t *testing.T, path string) string {
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	return string(content)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// commitAll writes the files given into the git repository at root
+// (creating the repository if need be), commits everything there,
+// and returns the commit hash.
+func commitAll(t *testing.T, root string, files map[string]string) string {
+	repo, err := git.PlainOpen(root)
+	if err == git.ErrRepositoryNotExists {
+		repo, err = git.PlainInit(root, false)
+	}
+	assert.NoError(t, err)
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	wt, err := repo.Worktree()
+	assert.NoError(t, err)
+	assert.NoError(t, wt.AddGlob("."))
+	hash, err := wt.Commit("commit", &git.CommitOptions{
+		All:    true,
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	assert.NoError(t, err)
+	return hash.String()
+}
+
+// chdir changes the working directory for the duration of the test.
+func chdir(t *testing.T, dir string) {
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+// configMap gives a ConfigMap with the value given.
+func configMap(value string) string {
+	return `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: gen
+data:
+  foo: ` + value + `
+`
+}
+
+// resourceFile is where the ConfigMap from configMap ends up in the
+// package.
+const resourceFile = "configmap.yaml"
+
+// makePackage imports a package from a git repository, with the
+// ConfigMap from configMap in it, into the directory "pkg" of another
+// git repository, and commits it there. It changes the working
+// directory to the root of the package's repository, and returns the
+// package directory (relative to it) and the upstream repository.
+func makePackage(t *testing.T) (string, string) {
+	upstream := writeFiles(t, nil)
+	version := commitAll(t, upstream, map[string]string{
+		"config/" + resourceFile: configMap("orig"),
+	})
+
+	root := writeFiles(t, nil)
+	chdir(t, root)
+	dir := "pkg"
+	assert.NoError(t, run(newImportGitCommand(), upstream+"//config", dir, "--version", version))
+	assert.Contains(t, readFile(t, filepath.Join(dir, resourceFile)), "foo: orig")
+	commitAll(t, root, nil)
+	return dir, upstream
+}
+
+// makeConflictedPackage makes a package as makePackage does, removes
+// the resource locally, then changes it upstream so that updating the
+// package conflicts with the removal. It returns the package
+// directory, and the upstream version to update to.
+func makeConflictedPackage(t *testing.T) (string, string) {
+	dir, upstream := makePackage(t)
+	assert.NoError(t, os.Remove(filepath.Join(dir, resourceFile)))
+	version := commitAll(t, upstream, map[string]string{
+		"config/" + resourceFile: configMap("yours"),
+	})
+	return dir, version
+}
+
+func run(cmd *cobra.Command, args ...string) error {
+	cmd.SetArgs(args)
+	cmd.SilenceUsage, cmd.SilenceErrors = true, true
+	return cmd.Execute()
+}
+
+func TestUpdateConflictContinue(t *testing.T) {
+	dir, version := makeConflictedPackage(t)
+
+	err := run(newUpdateCommand(), "--version", version, dir)
+	assert.Equal(t, errUnresolved, err)
+	state, err := loadMergeState(dir)
+	assert.NoError(t, err)
+	if assert.Len(t, state.Conflicts, 1) {
+		assert.Equal(t, resourceFile, state.Conflicts[0].Path)
+		assert.Equal(t, merge.ConflictRemovedLocally, state.Conflicts[0].Class)
+	}
+	// the local version stays put until the conflict is resolved
+	assert.False(t, exists(filepath.Join(dir, resourceFile)))
+	docs, err := readConflictFile(dir, resourceFile)
+	assert.NoError(t, err)
+	if assert.Len(t, docs, 1) {
+		assert.Equal(t, yaml.NodeTagNull, docs[0].Mine.Tag)
+		for _, side := range []struct {
+			node  *yaml.Node
+			value string
+		}{
+			{docs[0].Orig, "orig"},
+			{docs[0].Yours, "yours"},
+		} {
+			value, err := yaml.NewRNode(side.node).Pipe(yaml.Lookup("data", "foo"))
+			assert.NoError(t, err)
+			assert.Equal(t, side.value, value.YNode().Value)
+		}
+	}
+
+	// another update can't be started, and the update can't be
+	// finished, until the conflict is resolved
+	assert.Error(t, run(newUpdateCommand(), dir))
+	assert.Equal(t, errUnresolved, run(newUpdateCommand(), "--continue", dir))
+
+	assert.Error(t, run(newResolveCommand(), dir, "ConfigMap/other"))
+	assert.NoError(t, run(newResolveCommand(), "--theirs", dir, "ConfigMap/gen"))
+	assert.Contains(t, readFile(t, filepath.Join(dir, resourceFile)), "foo: yours")
+	assert.False(t, exists(filepath.Join(dir, resourceFile+conflictSuffix)))
+
+	assert.NoError(t, run(newUpdateCommand(), "--continue", dir))
+	_, err = loadMergeState(dir)
+	assert.Equal(t, errNoMergeState, err)
+	assert.False(t, exists(filepath.Join(dir, mergeStateDir)))
+	assert.Contains(t, readFile(t, filepath.Join(dir, Spresmfile)), version)
+}
+
+func TestUpdateConflictResolveByHand(t *testing.T) {
+	dir, version := makeConflictedPackage(t)
+	assert.Equal(t, errUnresolved, run(newUpdateCommand(), "--version", version, dir))
+
+	// take the generated version, but edit it
+	path := filepath.Join(dir, resourceFile)
+	docs, err := readConflictFile(dir, resourceFile)
+	assert.NoError(t, err)
+	yours, err := yaml.NewRNode(docs[0].Yours).String()
+	assert.NoError(t, err)
+	edited := strings.Replace(yours, "foo: yours", "foo: both", 1)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(edited), 0644))
+	// a conflict can be referred to by its file
+	assert.NoError(t, run(newResolveCommand(), dir, resourceFile))
+	assert.Contains(t, readFile(t, path), "foo: both")
+	assert.NoError(t, run(newUpdateCommand(), "--continue", dir))
+	assert.Contains(t, readFile(t, path), "foo: both")
+
+	// once the result is committed, a later update merges with what
+	// was generated, so the edit is kept
+	commitAll(t, ".", nil)
+	assert.NoError(t, run(newUpdateCommand(), dir))
+	assert.Contains(t, readFile(t, path), "foo: both")
+}
+
+func TestUpdateConflictAbort(t *testing.T) {
+	dir, version := makeConflictedPackage(t)
+	specBefore := readFile(t, filepath.Join(dir, Spresmfile))
+
+	assert.Equal(t, errUnresolved, run(newUpdateCommand(), "--version", version, dir))
+	assert.NotEqual(t, specBefore, readFile(t, filepath.Join(dir, Spresmfile)))
+
+	assert.NoError(t, run(newUpdateCommand(), "--abort", dir))
+	assert.Equal(t, specBefore, readFile(t, filepath.Join(dir, Spresmfile)))
+	assert.False(t, exists(filepath.Join(dir, resourceFile)))
+	assert.False(t, exists(filepath.Join(dir, resourceFile+conflictSuffix)))
+	assert.False(t, exists(filepath.Join(dir, mergeStateDir)))
+
+	assert.Equal(t, errNoMergeState, run(newUpdateCommand(), "--abort", dir))
+}
+
+func TestUpdateConflictAbortRestoresMerged(t *testing.T) {
+	dir, upstream := makePackage(t)
+	other := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: other\ndata:\n  foo: "
+	version := commitAll(t, upstream, map[string]string{
+		"config/other.yaml": other + "orig\n",
+	})
+	assert.NoError(t, run(newUpdateCommand(), "--version", version, dir))
+	commitAll(t, ".", nil)
+
+	// the ConfigMap is edited locally and changed upstream, so it's
+	// merged; the other one is removed locally and changed upstream,
+	// so it conflicts
+	path := filepath.Join(dir, resourceFile)
+	edited := strings.Replace(readFile(t, path), "foo: orig", "foo: orig\n  bar: mine", 1)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(edited), 0644))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "other.yaml")))
+	version = commitAll(t, upstream, map[string]string{
+		"config/" + resourceFile: configMap("yours"),
+		"config/other.yaml":      other + "yours\n",
+	})
+	assert.Equal(t, errUnresolved, run(newUpdateCommand(), "--version", version, dir))
+	assert.Contains(t, readFile(t, path), "foo: yours")
+	assert.Contains(t, readFile(t, path), "bar: mine")
+
+	assert.NoError(t, run(newUpdateCommand(), "--abort", dir))
+	assert.Contains(t, readFile(t, path), "foo: orig")
+	assert.Contains(t, readFile(t, path), "bar: mine")
+	assert.False(t, exists(filepath.Join(dir, "other.yaml")))
+}
+
+func TestFindConflict(t *testing.T) {
+	id := func(kind, namespace, name string) yaml.ResourceIdentifier {
+		return yaml.ResourceIdentifier{
+			TypeMeta: yaml.TypeMeta{Kind: kind},
+			NameMeta: yaml.NameMeta{Namespace: namespace, Name: name},
+		}
+	}
+	state := &mergeState{Conflicts: []conflictRecord{
+		{Resource: id("Deployment", "", "app"), Path: "deployment.yaml", Class: merge.ConflictRemovedLocally},
+		{Resource: id("Service", "a", "app"), Path: "services.yaml", Class: merge.ConflictRemovedLocally},
+		{Resource: id("Service", "b", "app"), Path: "services.yaml", Class: merge.ConflictRemovedLocally},
+	}}
+	for ref, want := range map[string]int{
+		"Deployment/app":    0,
+		"deployment/app":    0,
+		"./deployment.yaml": 0,
+		"Service/b/app":     2,
+		"Service/app":       -1, // ambiguous
+		"services.yaml":     -1, // ambiguous
+		"ConfigMap/app":     -1,
+	} {
+		i, err := state.findConflict(ref)
+		assert.Equal(t, want, i, ref)
+		assert.Equal(t, want < 0, err != nil, ref)
+	}
+}
+
+func TestConflictFileRoundTrip(t *testing.T) {
+	dir := writeFiles(t, nil)
+	node, err := yaml.Parse("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: gen\n")
+	assert.NoError(t, err)
+	docs := []conflictDoc{{
+		Conflict: "deleted locally, changed upstream",
+		Resource: yaml.ResourceIdentifier{TypeMeta: yaml.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"}, NameMeta: yaml.NameMeta{Name: "gen"}},
+		Orig:     node.YNode(),
+		Yours:    node.YNode(),
+	}}
+	assert.NoError(t, writeConflictFile(dir, "sub/gen.yaml", docs))
+	read, err := readConflictFile(dir, "sub/gen.yaml")
+	assert.NoError(t, err)
+	if assert.Len(t, read, 1) {
+		assert.Equal(t, docs[0].Conflict, read[0].Conflict)
+		assert.Equal(t, docs[0].Resource, read[0].Resource)
+		// a missing side is written as null
+		assert.Equal(t, yaml.NodeTagNull, read[0].Mine.Tag)
+		meta, err := yaml.NewRNode(read[0].Yours).GetMeta()
+		assert.NoError(t, err)
+		assert.Equal(t, "gen", meta.Name)
+	}
+
+	// writing no documents removes the file
+	assert.NoError(t, writeConflictFile(dir, "sub/gen.yaml", nil))
+	assert.False(t, exists(filepath.Join(dir, "sub", "gen.yaml"+conflictSuffix)))
+}
+
+func TestUpdateWriteFailureKeepsBase(t *testing.T) {
+	for _, args := range [][]string{nil, {"--overwrite"}} {
+		dir, upstream := makePackage(t)
+		// the update adds a resource, and a directory where it is to
+		// be written makes writing the package fail
+		version := commitAll(t, upstream, map[string]string{
+			"config/" + resourceFile: configMap("yours"),
+			"config/extra.yaml":      "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: extra\n",
+		})
+		assert.NoError(t, os.Mkdir(filepath.Join(dir, "extra.yaml"), 0755))
+		assert.Error(t, run(newUpdateCommand(), append(args, "--version", version, dir)...), args)
+
+		// .. and the base is still what was generated before
+		base, err := readBase(dir)
+		assert.NoError(t, err)
+		if assert.Len(t, base, 1, args) {
+			value, err := base[0].Pipe(yaml.Lookup("data", "foo"))
+			assert.NoError(t, err)
+			assert.Equal(t, "orig", value.YNode().Value, args)
+		}
+	}
+}
+
+func TestCopyFileKeepsMode(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"from":     "content",
+		"existing": "old",
+	})
+	from := filepath.Join(dir, "from")
+	assert.NoError(t, os.Chmod(from, 0644))
+	assert.NoError(t, os.Chmod(filepath.Join(dir, "existing"), 0600))
+	for _, to := range []string{"new", "existing"} {
+		path := filepath.Join(dir, to)
+		assert.NoError(t, copyFile(from, path))
+		assert.Equal(t, "content", readFile(t, path))
+		info, err := os.Stat(path)
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0644), info.Mode().Perm(), to)
+	}
+
+	err := copyFile(filepath.Join(dir, "missing"), filepath.Join(dir, "to"))
+	assert.True(t, os.IsNotExist(err))
+}
@@ -15,22 +15,39 @@ import (
 )
 
 // TODO move to somewhere else
-const Spresmfile = "Spresmfile"
+const (
+	Spresmfile = "Spresmfile"
+	Lockfile   = Spresmfile + ".lock"
+)
+
+type evalFlags struct {
+	refreshLock bool
+}
+
+func (flags *evalFlags) init(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&flags.refreshLock, "refresh-lock", false, "ignore the digest recorded in the lock file")
+}
 
-func evalCmd(cmd *cobra.Command, args []string) error {
+func (flags *evalFlags) run(cmd *cobra.Command, args []string) error {
 	if len(args) != 1 {
 		return errors.New("eval expects exactly one argument")
 	}
 	dir := args[0]
 
-	spec, err := getSpec(dir)
+	s, err := getSpec(dir)
 	if err != nil {
 		return err
 	}
+	var lock *spec.Lock
+	if !flags.refreshLock {
+		if lock, err = getLock(dir); err != nil {
+			return err
+		}
+	}
 
-	nodes, err := eval.Eval(spec)
+	nodes, _, err := eval.Eval(dir, s, lock)
 	if err != nil {
-		return fmt.Errorf("unable to evaluate spec file in %s: %w", dir, err)
+		return evalError(dir, err)
 	}
 
 	// FIXME print out for now
@@ -57,3 +74,37 @@ func getSpec(dir string) (spec.Spec, error) {
 	}
 	return spec, nil
 }
+
+// getLock reads the lock file in the directory given, if there is
+// one; if not, it returns nil.
+func getLock(dir string) (*spec.Lock, error) {
+	lockpath := filepath.Join(dir, Lockfile)
+	lockfile, err := os.Open(lockpath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not open lock file %s: %w", lockpath, err)
+	}
+	defer lockfile.Close()
+
+	lock := &spec.Lock{}
+	if err := yaml.NewDecoder(lockfile).Decode(lock); err != nil {
+		return nil, fmt.Errorf("unable to decode lock file at %s: %w", lockpath, err)
+	}
+	return lock, nil
+}
+
+// evalError gives a helpful error for a failure to evaluate the spec
+// in the directory given.
+func evalError(dir string, err error) error {
+	var mismatch *eval.LockMismatchError
+	if errors.As(err, &mismatch) {
+		fmt.Fprintf(os.Stderr, `
+The digest recorded in %s does not match what
+is now at the source. If the change is expected, use --refresh-lock
+to evaluate it anyway and record the new digest.
+`, filepath.Join(dir, Lockfile))
+	}
+	return fmt.Errorf("unable to evaluate spec file in %s: %w", dir, err)
+}
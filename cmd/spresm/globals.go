@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/squaremo/spresm/pkg/cache"
+	"github.com/squaremo/spresm/pkg/config"
+	"github.com/squaremo/spresm/pkg/eval"
+)
+
+// globalFlags are the flags that apply to all commands.
+type globalFlags struct {
+	offline    bool
+	noCache    bool
+	cacheDir   string
+	configFile string
+	runtime    string
+}
+
+func (flags *globalFlags) init(cmd *cobra.Command) {
+	cmd.PersistentFlags().BoolVar(&flags.offline, "offline", false, "use only what's in the cache, and don't download anything")
+	cmd.PersistentFlags().BoolVar(&flags.noCache, "no-cache", false, "don't use the cache for chart repositories and archives")
+	cmd.PersistentFlags().StringVar(&flags.cacheDir, "cache-dir", "", "directory for the cache (default is $XDG_CACHE_HOME/spresm)")
+	cmd.PersistentFlags().StringVar(&flags.configFile, "config", "", "path to the config file (default is $XDG_CONFIG_HOME/spresm/config.yaml)")
+	cmd.PersistentFlags().StringVar(&flags.runtime, "container-runtime", "", "container runtime for evaluating images; one of "+strings.Join(eval.RuntimeNames, ", ")+" (default is $"+eval.RuntimeEnv+", or the config file, or docker)")
+}
+
+func (flags *globalFlags) run(cmd *cobra.Command, args []string) error {
+	if flags.offline && flags.noCache {
+		return fmt.Errorf("--offline uses only what's in the cache, so it cannot be given with --no-cache")
+	}
+	conf, err := flags.config()
+	if err != nil {
+		return err
+	}
+	eval.UserConfig = conf
+
+	if name := flags.runtimeName(conf); name != "" {
+		runtime, err := eval.NewContainerRuntime(name)
+		if err != nil {
+			return err
+		}
+		eval.Runtime = runtime
+	}
+
+	if flags.noCache {
+		return nil
+	}
+	c, err := flags.cache()
+	if err != nil {
+		return err
+	}
+	eval.ChartCache = c
+	return nil
+}
+
+// config loads the user config, including the repositories from
+// Helm's repositories file.
+func (flags *globalFlags) config() (*config.Config, error) {
+	path := flags.configFile
+	if path == "" {
+		var err error
+		if path, err = config.DefaultPath(); err != nil {
+			return nil, err
+		}
+	}
+	conf, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := conf.AddHelmRepositories(config.HelmRepositoriesPath()); err != nil {
+		return nil, fmt.Errorf("could not load Helm repositories: %w", err)
+	}
+	return conf, nil
+}
+
+// runtimeName gives the name of the container runtime to use, from
+// the flag, the environment, or the config, in that order of
+// precedence.
+func (flags *globalFlags) runtimeName(conf *config.Config) string {
+	if flags.runtime != "" {
+		return flags.runtime
+	}
+	if name := os.Getenv(eval.RuntimeEnv); name != "" {
+		return name
+	}
+	return conf.Runtime()
+}
+
+// cache constructs the cache as given by the flags.
+func (flags *globalFlags) cache() (*cache.Cache, error) {
+	dir := flags.cacheDir
+	if dir == "" {
+		var err error
+		if dir, err = cache.DefaultDir(); err != nil {
+			return nil, err
+		}
+	}
+	c := cache.New(dir)
+	c.Offline = flags.offline
+	return c, nil
+}
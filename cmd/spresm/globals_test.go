@@ -0,0 +1,15 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobalFlagsOfflineNoCache(t *testing.T) {
+	flags := &globalFlags{offline: true, noCache: true}
+	err := flags.run(nil, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "--no-cache")
+	}
+}
@@ -2,18 +2,22 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 
 	"github.com/spf13/cobra"
 	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart"
 	"sigs.k8s.io/kustomize/kyaml/kio"
 
 	"github.com/squaremo/spresm/pkg/eval"
+	"github.com/squaremo/spresm/pkg/merge"
 	"github.com/squaremo/spresm/pkg/spec"
 )
 
@@ -24,11 +28,15 @@ const (
 func newImportCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "import",
-		Short: `import a package from a git repository, chart or image`,
+		Short: `import a package from a git repository, chart, kustomization, image, executable or Starlark script`,
 	}
 	cmd.AddCommand(
 		newImportHelmChartCommand(),
 		newImportImageCommand(),
+		newImportGitCommand(),
+		newImportExecCommand(),
+		newImportStarlarkCommand(),
+		newImportKustomizeCommand(),
 	)
 	return cmd
 }
@@ -43,7 +51,7 @@ func ensurePackageDirectory(dir string) error {
 	case err != nil:
 		return fmt.Errorf("error trying to establish import directory %s: %w", dir, err)
 	case !dirstat.IsDir():
-		return fmt.Errorf("expected %s to be a directory or not exist yet")
+		return fmt.Errorf("expected %s to be a directory or not exist yet", dir)
 	default:
 		// exists already, and is a directory
 		d, err := os.Open(dir)
@@ -74,6 +82,19 @@ func writeSpec(dir string, s spec.Spec) (string, error) {
 	return specPath, nil
 }
 
+func writeLock(dir string, lock *spec.Lock) error {
+	lockPath := filepath.Join(dir, Lockfile)
+	buf := &bytes.Buffer{}
+	err := yaml.NewEncoder(buf).Encode(lock)
+	if err == nil {
+		err = ioutil.WriteFile(lockPath, buf.Bytes(), os.FileMode(0600))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode and write lock to %s: %w", lockPath, err)
+	}
+	return nil
+}
+
 func writePackage(dir string, s spec.Spec) error {
 	specPath, err := writeSpec(dir, s)
 	if err != nil {
@@ -83,16 +104,30 @@ func writePackage(dir string, s spec.Spec) error {
 
 	// eval the spec, to render the chart into the directory. TODO
 	// stick it in pkg somewhere.
-	resources, err := eval.Eval(s)
+	resources, lock, err := eval.Eval(dir, s, nil)
+	if err != nil {
+		return fmt.Errorf("unable to evaluate spec: %w", err)
+	}
+	if err := writeLock(dir, lock); err != nil {
+		return err
+	}
+	if err := stageBase(dir, resources); err != nil {
+		return err
+	}
 	writer := kio.LocalPackageWriter{PackagePath: dir}
 	if err := writer.Write(resources); err != nil {
 		return fmt.Errorf("problem writing to the directory %s/: %w", dir, err)
 	}
+	if err := commitBase(dir); err != nil {
+		return err
+	}
 	fmt.Fprintf(os.Stderr, "spec evaluated to %s/\n", dir)
 	return nil
 }
 
-func editConfig(initialConfig interface{}) (io.Reader, error) {
+// editConfig presents the config given in an editor, and returns the
+// result. Any header lines given are shown as comments at the top.
+func editConfig(initialConfig interface{}, header ...string) (io.Reader, error) {
 	// present the chart default values for editing
 	tmpvalues, err := ioutil.TempFile("", "spresm-edit")
 	if err != nil {
@@ -100,6 +135,10 @@ func editConfig(initialConfig interface{}) (io.Reader, error) {
 	}
 	defer os.Remove(tmpvalues.Name())
 
+	for _, line := range header {
+		fmt.Fprintf(tmpvalues, "# %s\n", line)
+	}
+
 	if err := yaml.NewEncoder(tmpvalues).Encode(initialConfig); err != nil {
 		return nil, fmt.Errorf("failed to write config to file for editing: %w", err)
 	}
@@ -121,6 +160,70 @@ func editConfig(initialConfig interface{}) (io.Reader, error) {
 	return bytes.NewBuffer(valuesBytes), nil
 }
 
+// editSpecConfig presents the config in the spec for editing, and
+// reads the result back into the spec. For a Helm chart, the values
+// are shown in full, including the chart's defaults, but only the
+// values that differ from the defaults are kept. They are also
+// checked against the chart's schema; if they don't conform, the
+// editor is opened again with the problems listed at the top. Saving
+// without changes gives up.
+func editSpecConfig(dir string, s *spec.Spec, lock *spec.Lock) error {
+	var chart *chart.Chart
+	var defaults map[string]interface{}
+	if s.Kind == spec.ChartKind {
+		var err error
+		chart, _, err = eval.LoadChart(dir, *s, lock)
+		if err != nil {
+			return err
+		}
+		defaults = chart.Values
+	}
+
+	var header []string
+	// the config as it was presented, after the first round; it's
+	// compared as parsed, since the text presented has the problems
+	// at the top
+	var previous *spec.HelmArgs
+	for {
+		config := s.Config()
+		if s.Kind == spec.ChartKind && s.Helm != nil {
+			config = helmEditConfig(*s.Helm, chart)
+		}
+		reader, err := editConfig(config, header...)
+		if err != nil {
+			return err
+		}
+		edited, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		if err := s.ReadConfig(bytes.NewReader(edited)); err != nil {
+			return fmt.Errorf("unable to re-read config after editing: %w", err)
+		}
+		if s.Kind != spec.ChartKind {
+			return nil
+		}
+		s.Helm.Values = merge.Overrides(s.Helm.Values, defaults)
+
+		err = eval.CheckValues(dir, *s, lock)
+		var valuesErr *eval.ValuesError
+		if !errors.As(err, &valuesErr) {
+			return err
+		}
+		if previous != nil && reflect.DeepEqual(*previous, *s.Helm) {
+			return err
+		}
+		helmArgs := *s.Helm
+		previous = &helmArgs
+		fmt.Fprintln(os.Stderr, err)
+		header = []string{"The values below do not conform to the chart's schema:"}
+		for _, v := range valuesErr.Violations {
+			header = append(header, "  - "+v.String())
+		}
+		header = append(header, "Fix them and save, or save without changes to give up.")
+	}
+}
+
 func editCommand(s string) string {
 	editor := os.Getenv("EDITOR")
 	if editor == "" {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+func newImportExecCommand() *cobra.Command {
+	flags := &importFunctionFlags{kind: spec.ExecKind}
+	cmd := &cobra.Command{
+		Use:   "exec <dir> --exec <path>",
+		Short: `import the output of a local executable, which speaks the ResourceList protocol, as a package`,
+		RunE:  flags.run,
+	}
+	cmd.Flags().StringVar(&flags.source, "exec", "", "path to the executable, or its name if it's in $PATH")
+	cmd.Flags().StringSliceVar(&flags.args, "arg", nil, "argument to give the executable (may be repeated)")
+	flags.init(cmd)
+	return cmd
+}
+
+func newImportStarlarkCommand() *cobra.Command {
+	flags := &importFunctionFlags{kind: spec.StarlarkKind}
+	cmd := &cobra.Command{
+		Use:   "starlark <dir> --script <path or URL>",
+		Short: `import the output of a Starlark script as a package`,
+		RunE:  flags.run,
+	}
+	cmd.Flags().StringVar(&flags.source, "script", "", "path or HTTP URL of the Starlark script")
+	flags.init(cmd)
+	return cmd
+}
+
+type importFunctionFlags struct {
+	kind   spec.Kind
+	source string
+	args   []string
+	items  string
+}
+
+func (flags *importFunctionFlags) init(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&flags.items, "items", "", `what to give the function as input items: "none" (the default) or "package"`)
+}
+
+func (flags *importFunctionFlags) run(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one argument, the directory in which to put the package files")
+	}
+	dir := args[0]
+	if flags.source == "" {
+		return fmt.Errorf("need the function to run (supply this with --exec or --script)")
+	}
+
+	if err := ensurePackageDirectory(dir); err != nil {
+		return err
+	}
+
+	var s spec.Spec
+	s.Init(flags.kind)
+	s.Source = flags.source
+	// A local path is recorded relative to the package directory, as
+	// for a local chart. A bare executable name is looked up in
+	// $PATH, so it's left alone.
+	bareName := flags.kind == spec.ExecKind && !strings.Contains(flags.source, "/")
+	if !strings.Contains(flags.source, "://") && !bareName {
+		source, err := localChartSource(dir, flags.source)
+		if err != nil {
+			return err
+		}
+		if flags.kind == spec.ExecKind && !strings.Contains(source, "/") {
+			source = "./" + source
+		}
+		s.Source = source
+	}
+	s.Function.Args = flags.args
+	s.Function.Items = spec.ImageItems(flags.items)
+	// In the absence of indications otherwise, use a ConfigMap. This
+	// is the convention for kyaml functions.
+	s.Function.FunctionConfig = map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"data":       map[string]string{},
+	}
+
+	if err := editSpecConfig(dir, &s, nil); err != nil {
+		return err
+	}
+
+	return writePackage(dir, s)
+}
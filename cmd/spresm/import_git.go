@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+func newImportGitCommand() *cobra.Command {
+	flags := &importGitFlags{}
+	cmd := &cobra.Command{
+		Use:   "git <repo URL>//<path> <dir> --version <version>",
+		Short: `import files from a git repository as a package`,
+		RunE:  flags.run,
+	}
+	flags.init(cmd)
+	return cmd
+}
+
+type importGitFlags struct {
+	version string
+}
+
+func (flags *importGitFlags) init(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&flags.version, "version", "", "tag, branch or commit of the git repository to use")
+}
+
+func (flags *importGitFlags) run(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected exactly two arguments, the git URL and path, and the directory in which to put the package files")
+	}
+	source, dir := args[0], args[1]
+	if flags.version == "" {
+		return fmt.Errorf("need a version (--version) naming a tag, branch or commit")
+	}
+
+	if err := ensurePackageDirectory(dir); err != nil {
+		return err
+	}
+
+	var s spec.Spec
+	s.Init(spec.GitKind)
+	s.Source = source
+	s.Version = flags.version
+
+	return writePackage(dir, s)
+}
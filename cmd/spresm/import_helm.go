@@ -24,12 +24,14 @@ func newImportHelmChartCommand() *cobra.Command {
 
 type importHelmChartFlags struct {
 	chartURL, version, namespace string
+	repository                   string
 }
 
 func (flags *importHelmChartFlags) init(cmd *cobra.Command) {
-	cmd.Flags().StringVar(&flags.chartURL, "chart", "", "URL for chart, including the repository; e.g., https://charts.fluxcd.io/flux")
-	cmd.Flags().StringVar(&flags.version, "version", "", "version of chart to use")
+	cmd.Flags().StringVar(&flags.chartURL, "chart", "", "URL for chart, including the repository; e.g., https://charts.fluxcd.io/flux, oci://ghcr.io/org/charts/app, or a path to a local chart directory or archive")
+	cmd.Flags().StringVar(&flags.version, "version", "", "version of chart to use; not given for a local chart, since its version is the digest of its contents")
 	cmd.Flags().StringVar(&flags.namespace, "namespace", "default", "namespace to deploy chart to")
+	cmd.Flags().StringVar(&flags.repository, "repository", "", "name of the repository settings (e.g., credentials) to use from the config file, Helm's repositories file, or the environment")
 }
 
 func (flags *importHelmChartFlags) run(cmd *cobra.Command, args []string) error {
@@ -37,9 +39,13 @@ func (flags *importHelmChartFlags) run(cmd *cobra.Command, args []string) error
 		return fmt.Errorf("expected exactly one argument, the directory in which to put the package files")
 	}
 	dir := args[0]
-	if flags.chartURL == "" || flags.version == "" {
+	local := eval.IsLocalChart(flags.chartURL)
+	if flags.chartURL == "" || (flags.version == "" && !local) {
 		return fmt.Errorf("need both chart URL (--chart) and version (--version) flags")
 	}
+	if local && flags.version != "" {
+		return fmt.Errorf("the version of a local chart is the digest of its contents, so --version cannot be given")
+	}
 
 	if err := ensurePackageDirectory(dir); err != nil {
 		return err
@@ -50,25 +56,59 @@ func (flags *importHelmChartFlags) run(cmd *cobra.Command, args []string) error
 	s.Init(spec.ChartKind)
 	s.Source = flags.chartURL
 	s.Version = flags.version
+	s.Helm.Repository = flags.repository
 
 	// get the chart
-	chart, err := eval.ProcureChart(flags.chartURL, flags.version)
+	chart, err := eval.ProcureChart(flags.chartURL, flags.version, flags.repository)
 	if err != nil {
 		return err
 	}
 	fmt.Fprintf(os.Stderr, "chart found %q\n", chart.Name())
 
+	// A local chart is recorded relative to the package directory, so
+	// the package can be evaluated from anywhere.
+	if local {
+		source, err := localChartSource(dir, flags.chartURL)
+		if err != nil {
+			return err
+		}
+		s.Source = source
+		if s.Version, err = eval.LocalChartVersion(dir, source); err != nil {
+			return err
+		}
+	}
+
 	s.Helm.Release.Name = filepath.Base(dir)
 	s.Helm.Release.Namespace = flags.namespace
 
-	valuesReader, err := editConfig(&spec.HelmArgs{Values: chart.Values})
-	if err != nil {
+	// the values start as the chart's defaults, i.e., no overrides
+	if err := editSpecConfig(dir, &s, nil); err != nil {
 		return err
 	}
 
-	if err := s.ReadConfig(valuesReader); err != nil {
-		return fmt.Errorf("unable to re-read config after editing: %w", err)
-	}
-
 	return writePackage(dir, s)
 }
+
+// localChartSource gives the source to record in the spec for a local
+// chart path given on the command line. Relative paths are rewritten
+// to be relative to the package directory; absolute paths are left
+// alone.
+func localChartSource(dir, chartPath string) (string, error) {
+	path := eval.LocalPath("", chartPath)
+	if filepath.IsAbs(path) {
+		return chartPath, nil
+	}
+	absChart, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absDir, absChart)
+	if err != nil {
+		return "", fmt.Errorf("could not make chart path relative to package directory: %w", err)
+	}
+	return filepath.ToSlash(rel), nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/squaremo/spresm/pkg/eval"
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+func newImportKustomizeCommand() *cobra.Command {
+	flags := &importKustomizeFlags{}
+	cmd := &cobra.Command{
+		Use:   "kustomize <dir> --source <path or git URL> --version <version>",
+		Short: `import the output of a kustomization as a package`,
+		RunE:  flags.run,
+	}
+	flags.init(cmd)
+	return cmd
+}
+
+type importKustomizeFlags struct {
+	source, version   string
+	loadRestrictor    string
+	enablePlugins     bool
+	addManagedByLabel bool
+}
+
+func (flags *importKustomizeFlags) init(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&flags.source, "source", "", "directory containing the kustomization; either a local path, or a git URL with the path appended after //, e.g., https://github.com/org/app.git//deploy/prod")
+	cmd.Flags().StringVar(&flags.version, "version", "", "tag, branch or commit of the git repository to use; not given for a local kustomization")
+	cmd.Flags().StringVar(&flags.loadRestrictor, "load-restrictor", "", `which files the kustomization may refer to: "rootOnly" (the default) for those in or under its directory, or "none" for any`)
+	cmd.Flags().BoolVar(&flags.enablePlugins, "enable-plugins", false, "enable kustomize plugins, including those used to inflate Helm charts")
+	cmd.Flags().BoolVar(&flags.addManagedByLabel, "add-managed-by-label", false, "add the label app.kubernetes.io/managed-by to the resources built")
+}
+
+func (flags *importKustomizeFlags) run(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected exactly one argument, the directory in which to put the package files")
+	}
+	dir := args[0]
+	local := eval.IsLocalKustomization(flags.source)
+	if flags.source == "" || (flags.version == "" && !local) {
+		return fmt.Errorf("need both the kustomization source (--source) and, for a git repository, the version (--version)")
+	}
+	if local && flags.version != "" {
+		return fmt.Errorf("a local kustomization has no version, so --version cannot be given")
+	}
+
+	if err := ensurePackageDirectory(dir); err != nil {
+		return err
+	}
+
+	var s spec.Spec
+	s.Init(spec.KustomizeKind)
+	s.Source = flags.source
+	s.Version = flags.version
+	s.Kustomize.LoadRestrictor = spec.LoadRestrictor(flags.loadRestrictor)
+	s.Kustomize.EnablePlugins = flags.enablePlugins
+	s.Kustomize.AddManagedByLabel = flags.addManagedByLabel
+
+	// A local kustomization is recorded relative to the package
+	// directory, as for a local chart.
+	if local {
+		source, err := localChartSource(dir, flags.source)
+		if err != nil {
+			return err
+		}
+		s.Source = source
+	}
+
+	if err := editSpecConfig(dir, &s, nil); err != nil {
+		return err
+	}
+
+	return writePackage(dir, s)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/squaremo/spresm/pkg/eval"
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// useEditor sets $EDITOR to a shell script which runs the commands
+// given, with the file to edit as $1, and counts how many times it
+// was run. It returns a function giving the count.
+func useEditor(t *testing.T, commands string) func() int {
+	dir := writeFiles(t, map[string]string{
+		"editor.sh": "echo x >> " + "$(dirname $0)/count\n" + commands,
+	})
+	previous, set := os.LookupEnv("EDITOR")
+	os.Setenv("EDITOR", "sh "+filepath.Join(dir, "editor.sh"))
+	t.Cleanup(func() {
+		if set {
+			os.Setenv("EDITOR", previous)
+		} else {
+			os.Unsetenv("EDITOR")
+		}
+	})
+	return func() int {
+		content, _ := ioutil.ReadFile(filepath.Join(dir, "count"))
+		return strings.Count(string(content), "x")
+	}
+}
+
+func TestEditSpecConfigInvalidValues(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"app/Chart.yaml":  "apiVersion: v2\nname: app\nversion: 0.1.0\n",
+		"app/values.yaml": "replicas: one\n",
+		"app/values.schema.json": `{
+  "type": "object",
+  "properties": {"replicas": {"type": "integer"}}
+}`,
+		"app/templates/cm.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n",
+	})
+	var s spec.Spec
+	s.Init(spec.ChartKind)
+	s.Source = filepath.Join(root, "app")
+
+	// saving without changes, when the problems are shown, gives up
+	count := useEditor(t, "")
+	err := editSpecConfig("", &s, nil)
+	var valuesErr *eval.ValuesError
+	assert.True(t, errors.As(err, &valuesErr))
+	assert.Equal(t, 2, count())
+
+	// .. and fixing the problems is accepted
+	count = useEditor(t, `[ -f "$(dirname $0)/fixed" ] || { touch "$(dirname $0)/fixed"; exit 0; }
+sed -i 's/replicas: one/replicas: 2/' "$1"
+`)
+	assert.NoError(t, editSpecConfig("", &s, nil))
+	assert.Equal(t, 2, count())
+	assert.Equal(t, map[string]interface{}{"replicas": 2}, s.Helm.Values)
+}
+
+func TestImportKustomizeLocal(t *testing.T) {
+	root := writeFiles(t, map[string]string{
+		"app/kustomization.yaml": "resources:\n- cm.yaml\n",
+		"app/cm.yaml":            "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n",
+	})
+	dir := filepath.Join(root, "pkg")
+	source := filepath.Join(root, "app")
+
+	// a local kustomization has no version
+	count := useEditor(t, "")
+	assert.Error(t, run(newImportKustomizeCommand(), dir, "--source", source, "--version", "v1"))
+	assert.Equal(t, 0, count())
+
+	// the arguments are presented for editing
+	count = useEditor(t, `sed -i 's/addManagedByLabel: true/loadRestrictor: none/' "$1"`)
+	assert.NoError(t, run(newImportKustomizeCommand(), dir, "--source", source, "--add-managed-by-label"))
+	assert.Equal(t, 1, count())
+	specFile := readFile(t, filepath.Join(dir, Spresmfile))
+	assert.Contains(t, specFile, "loadRestrictor: none")
+	assert.NotContains(t, specFile, "addManagedByLabel")
+	assert.True(t, exists(filepath.Join(dir, "configmap_app.yaml")))
+}
+
+func TestImportUpdateNonResource(t *testing.T) {
+	script := func(value string) string {
+		return `ctx.resource_list["items"] = [
+  {"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "gen"}},
+  {"settings": {` + value + `}},
+]
+`
+	}
+	root := writeFiles(t, map[string]string{"gen.star": script(`"a": "b"`)})
+	dir := filepath.Join(root, "pkg")
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+
+	var s spec.Spec
+	s.Init(spec.StarlarkKind)
+	s.Source = "../gen.star"
+	s.Function.FunctionConfig = map[string]interface{}{}
+	assert.NoError(t, writePackage(dir, s))
+	path := filepath.Join(dir, "documents.yaml")
+	assert.Equal(t, "settings:\n  a: b\n", readFile(t, path))
+
+	// a local change to the document is merged with a change
+	// upstream, rather than the document being duplicated
+	assert.NoError(t, ioutil.WriteFile(path, []byte("settings:\n  a: local\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "gen.star"), []byte(script(`"a": "b", "c": "d"`)), 0644))
+	assert.NoError(t, run(newUpdateCommand(), dir))
+	assert.Equal(t, "settings:\n  a: local\n  c: d\n", readFile(t, path))
+}
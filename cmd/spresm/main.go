@@ -5,25 +5,34 @@ import (
 )
 
 func main() {
+	globals := &globalFlags{}
 	root := &cobra.Command{
-		Use:   "spresm",
-		Short: `spresm import|update|eval|build`,
+		Use:               "spresm",
+		Short:             `spresm import|update|resolve|values|eval|build|cache`,
+		PersistentPreRunE: globals.run,
 	}
+	globals.init(root)
 	root.AddCommand(
 		newImportCommand(),
 		newUpdateCommand(),
+		newResolveCommand(),
+		newValuesCommand(),
 		newEvalCommand(),
 		newBuildCommand(),
+		newCacheCommand(),
 	)
 	root.Execute()
 }
 
 func newEvalCommand() *cobra.Command {
-	return &cobra.Command{
+	flags := &evalFlags{}
+	cmd := &cobra.Command{
 		Use:   "eval <dir>",
 		Short: `evaluate the spec file in <dir> and show the output`,
-		RunE:  evalCmd,
+		RunE:  flags.run,
 	}
+	flags.init(cmd)
+	return cmd
 }
 
 func newBuildCommand() *cobra.Command {
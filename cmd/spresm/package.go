@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/squaremo/spresm/pkg/eval"
+)
+
+// stateDir is the directory, within a package, in which spresm keeps
+// its own records. Files in it are not part of the package.
+const stateDir = eval.StateDir
+
+// packageReadWriter reads and writes the resources in a package
+// directory, like kio.LocalPackageReadWriter, but leaves out spresm's
+// own files.
+type packageReadWriter struct {
+	dir string
+	// files that aren't resources of the package, e.g., patches used
+	// by the spec's pipeline
+	exclude []string
+	// the files read, so those that are no longer present on
+	// writing can be deleted.
+	files map[string]bool
+}
+
+// packageFor gives a packageReadWriter for the package directory
+// given, which leaves out the files used by its spec's pipeline.
+func packageFor(dir string) (*packageReadWriter, error) {
+	s, err := getSpec(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &packageReadWriter{dir: dir, exclude: s.PipelineFiles()}, nil
+}
+
+func (rw *packageReadWriter) Read() ([]*yaml.RNode, error) {
+	nodes, err := eval.ReadPackage(rw.dir, rw.exclude...)
+	if err != nil {
+		return nil, err
+	}
+	rw.files = map[string]bool{}
+	for _, node := range nodes {
+		path, _, err := kioutil.GetFileAnnotations(node)
+		if err != nil {
+			return nil, err
+		}
+		rw.files[path] = true
+	}
+	return nodes, nil
+}
+
+func (rw *packageReadWriter) Write(nodes []*yaml.RNode) error {
+	// LocalPackageWriter clears the path annotations as it writes, so
+	// note which files are to be written beforehand.
+	if err := kioutil.DefaultPathAndIndexAnnotation("", nodes); err != nil {
+		return err
+	}
+	written := map[string]bool{}
+	for _, node := range nodes {
+		path, _, err := kioutil.GetFileAnnotations(node)
+		if err != nil {
+			return err
+		}
+		written[path] = true
+	}
+	if err := (kio.LocalPackageWriter{PackagePath: rw.dir}).Write(nodes); err != nil {
+		return err
+	}
+	for path := range rw.files {
+		if !written[path] {
+			if err := os.Remove(filepath.Join(rw.dir, path)); err != nil {
+				return fmt.Errorf("could not remove file %s: %w", path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// stripFileAnnotations returns a copy of the node given, without the
+// annotations recording where it was read from.
+func stripFileAnnotations(node *yaml.RNode) (*yaml.RNode, error) {
+	node = node.Copy()
+	if err := node.PipeE(yaml.ClearAnnotation(kioutil.PathAnnotation)); err != nil {
+		return nil, err
+	}
+	if err := node.PipeE(yaml.ClearAnnotation(kioutil.IndexAnnotation)); err != nil {
+		return nil, err
+	}
+	if err := yaml.ClearEmptyAnnotations(node); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// writeSnapshot writes the resources given to the directory given,
+// replacing anything already there. This is for keeping copies of
+// resources in the state directory.
+func writeSnapshot(path string, nodes []*yaml.RNode) error {
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path, os.FileMode(0700)); err != nil {
+		return err
+	}
+	// the writer clears annotations as it goes, so give it copies
+	var copies []*yaml.RNode
+	for _, node := range nodes {
+		copies = append(copies, node.Copy())
+	}
+	return kio.LocalPackageWriter{PackagePath: path}.Write(copies)
+}
+
+// readSnapshot reads the resources written to the directory given by
+// writeSnapshot.
+func readSnapshot(path string) ([]*yaml.RNode, error) {
+	return kio.LocalPackageReader{PackagePath: path}.Read()
+}
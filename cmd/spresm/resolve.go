@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func newResolveCommand() *cobra.Command {
+	flags := &resolveFlags{}
+	cmd := &cobra.Command{
+		Use:   "resolve <dir> [--ours|--theirs] <resource>",
+		Short: `mark a conflict from an update as resolved, optionally picking a side`,
+		Long: `Mark a conflict from an update as resolved. The resource is given
+as <kind>/<name>, <kind>/<namespace>/<name>, or as the file it is in.
+
+With --ours, the resource is kept as it was locally; with --theirs,
+it is replaced with the newly generated version. Without either, the
+resource is taken as it is now in the package directory, e.g., after
+being edited by hand.`,
+		RunE: flags.run,
+	}
+	flags.init(cmd)
+	return cmd
+}
+
+type resolveFlags struct {
+	ours, theirs bool
+}
+
+func (flags *resolveFlags) init(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&flags.ours, "ours", false, "resolve the conflict by using the local version of the resource")
+	cmd.Flags().BoolVar(&flags.theirs, "theirs", false, "resolve the conflict by using the generated version of the resource")
+}
+
+func (flags *resolveFlags) run(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected exactly two arguments, the package directory and the resource")
+	}
+	if flags.ours && flags.theirs {
+		return fmt.Errorf("only one of --ours and --theirs can be given")
+	}
+	dir, ref := args[0], args[1]
+
+	state, err := loadMergeState(dir)
+	if err != nil {
+		return err
+	}
+	i, err := state.findConflict(ref)
+	if err != nil {
+		return err
+	}
+	record := state.Conflicts[i]
+
+	docs, err := readConflictFile(dir, record.Path)
+	if err != nil {
+		return err
+	}
+	var remaining []conflictDoc
+	var doc *conflictDoc
+	for j := range docs {
+		if docs[j].Resource == record.Resource && docs[j].Index == record.Index {
+			doc = &docs[j]
+		} else {
+			remaining = append(remaining, docs[j])
+		}
+	}
+	if doc == nil {
+		return fmt.Errorf("conflict for %s not found in %s", record, record.Path+conflictSuffix)
+	}
+
+	if flags.ours || flags.theirs {
+		choice := doc.Mine
+		if flags.theirs {
+			choice = doc.Yours
+		}
+		if err := replaceResource(dir, record, choice); err != nil {
+			return err
+		}
+	}
+
+	if err := writeConflictFile(dir, record.Path, remaining); err != nil {
+		return err
+	}
+	state.Conflicts = append(state.Conflicts[:i], state.Conflicts[i+1:]...)
+	if err := writeMergeState(dir, state); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Resolved %s\n", record)
+	if len(state.Conflicts) > 0 {
+		fmt.Fprintf(os.Stderr, "%d conflict(s) remain\n", len(state.Conflicts))
+	} else {
+		fmt.Fprintf(os.Stderr, "All conflicts resolved; use 'spresm update --continue %s' to finish the update\n", dir)
+	}
+	return nil
+}
+
+// replaceResource replaces the resource in the conflict record given
+// with the version given, or removes it if the version is nil (or a
+// YAML null, as it will be when read from a conflict file).
+func replaceResource(dir string, record conflictRecord, version *yaml.Node) error {
+	rw, err := packageFor(dir)
+	if err != nil {
+		return err
+	}
+	nodes, err := rw.Read()
+	if err != nil {
+		return fmt.Errorf("could not parse local files: %w", err)
+	}
+
+	var result []*yaml.RNode
+	index := ""
+	for _, node := range nodes {
+		if record.Resource == (yaml.ResourceIdentifier{}) {
+			// not a resource, so identified by where it is
+			path, i, err := kioutil.GetFileAnnotations(node)
+			if err == nil && path == record.Path && i == record.Index {
+				index = i
+				continue
+			}
+		} else if meta, err := node.GetMeta(); err == nil && meta.GetIdentifier() == record.Resource {
+			index = meta.Annotations[kioutil.IndexAnnotation]
+			continue
+		}
+		result = append(result, node)
+	}
+
+	if version != nil && version.Tag != yaml.NodeTagNull {
+		node := yaml.NewRNode(version)
+		if err := node.PipeE(yaml.SetAnnotation(kioutil.PathAnnotation, record.Path)); err != nil {
+			return err
+		}
+		// if it's replacing a resource, put it in the same place;
+		// otherwise, the writer will put it at the end of the file.
+		if _, err := strconv.Atoi(index); err == nil {
+			if err := node.PipeE(yaml.SetAnnotation(kioutil.IndexAnnotation, index)); err != nil {
+				return err
+			}
+		}
+		result = append(result, node)
+	}
+
+	if err := rw.Write(result); err != nil {
+		return fmt.Errorf("failed to write files back to directory %s: %w", dir, err)
+	}
+	return nil
+}
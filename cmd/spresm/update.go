@@ -9,7 +9,6 @@ import (
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/spf13/cobra"
-	"sigs.k8s.io/kustomize/kyaml/kio"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 
 	"github.com/squaremo/spresm/pkg/eval"
@@ -33,13 +32,20 @@ type updateFlags struct {
 	version   string // change the version
 	overwrite bool   // overwrite the files in the local dir, rather than merging
 	base      string // use this ref for the base revision when merging
+	cont      bool   // continue an update that had conflicts
+	abort     bool   // abort an update that had conflicts
+
+	refreshLock bool // ignore the digest in the lock file
 }
 
 func (flags *updateFlags) init(cmd *cobra.Command) {
 	cmd.Flags().BoolVar(&flags.edit, "edit", false, "present the package config for editing before updating")
 	cmd.Flags().BoolVar(&flags.overwrite, "overwrite", false, "overwrite files rather than attempting a 3-way merge")
 	cmd.Flags().StringVar(&flags.version, "version", "", "change the package version to this value")
-	cmd.Flags().StringVar(&flags.base, "base", "HEAD", "use this git ref for the base revision when merging")
+	cmd.Flags().StringVar(&flags.base, "base", "HEAD", "evaluate the spec at this git ref for the base revision when merging, rather than using the recorded base revision")
+	cmd.Flags().BoolVar(&flags.cont, "continue", false, "finish an update that had conflicts, once they are resolved")
+	cmd.Flags().BoolVar(&flags.refreshLock, "refresh-lock", false, "ignore the digest recorded in the lock file, and record the new digest")
+	cmd.Flags().BoolVar(&flags.abort, "abort", false, "abandon an update that had conflicts, restoring the files as they were before")
 }
 
 func (flags *updateFlags) run(cmd *cobra.Command, args []string) error {
@@ -48,6 +54,21 @@ func (flags *updateFlags) run(cmd *cobra.Command, args []string) error {
 	}
 	dir := args[0]
 
+	switch {
+	case flags.cont && flags.abort:
+		return errors.New("only one of --continue and --abort can be given")
+	case flags.cont:
+		return continueUpdate(dir)
+	case flags.abort:
+		return abortUpdate(dir)
+	}
+	if state, err := loadMergeState(dir); err == nil {
+		reportUnresolved(state)
+		return fmt.Errorf("an update of %s is already in progress", dir)
+	} else if err != errNoMergeState {
+		return err
+	}
+
 	// get the spec as it is in the file system
 	updatedSpec, err := getSpec(dir)
 	if err != nil {
@@ -56,46 +77,80 @@ func (flags *updateFlags) run(cmd *cobra.Command, args []string) error {
 
 	writeBackSpec := false
 
+	var lock *spec.Lock
+	if !flags.refreshLock {
+		if lock, err = getLock(dir); err != nil {
+			return err
+		}
+	}
+
+	// A local chart's version is the digest of its contents, so it's
+	// brought up to date with the chart, rather than given.
+	if updatedSpec.Kind == spec.ChartKind && eval.IsLocalChart(updatedSpec.Source) {
+		if flags.version != "" {
+			return fmt.Errorf("the version of a local chart is the digest of its contents, so --version cannot be given")
+		}
+		version, err := eval.LocalChartVersion(dir, updatedSpec.Source)
+		if err != nil {
+			return err
+		}
+		if version != updatedSpec.Version {
+			writeBackSpec = true
+			updatedSpec.Version = version
+		}
+	}
+
 	if flags.version != "" {
 		writeBackSpec = true
+		origSpec := updatedSpec
 		updatedSpec.Version = flags.version
+		// the chart defaults may have changed, and values that
+		// weren't overridden should follow them.
+		if updatedSpec.Kind == spec.ChartKind && origSpec.Version != updatedSpec.Version {
+			if err := mergeChartValues(dir, origSpec, &updatedSpec, lock); err != nil {
+				return err
+			}
+		}
 	}
 
 	// if --edit, extract the package config and present it for
 	// editing.
 	if flags.edit {
 		writeBackSpec = true
-		configReader, err := editConfig(updatedSpec.Config())
-		if err != nil {
+		if err := editSpecConfig(dir, &updatedSpec, lock); err != nil {
 			return err
 		}
-		if err := updatedSpec.ReadConfig(configReader); err != nil {
-			return fmt.Errorf("unable to re-read config after editing: %w", err)
-		}
 	}
 
-	destRW := kio.LocalPackageReadWriter{
-		PackagePath: dir,
-		// Just to be explicit. If overwriting, we want to delete
-		// files that no longer feature in the output. If merging,
-		// we'll be deciding for each resource whether it stays or
-		// goes in the merged results; so again, if there's nothing
-		// left in a file it can be deleted.
-		NoDeleteFiles: false,
-	}
+	// If overwriting, we want to delete files that no longer
+	// feature in the output. If merging, we'll be deciding for each
+	// resource whether it stays or goes in the merged results; so
+	// again, if there's nothing left in a file it can be deleted.
+	destRW := &packageReadWriter{dir: dir, exclude: updatedSpec.PipelineFiles()}
 	dest, err := destRW.Read()
 	if err != nil {
 		return fmt.Errorf("could not parse local files: %w", err)
 	}
 
+	// any conflicts are reported after the spec is written back, so
+	// that it agrees with the merged files.
+	var conflicts []merge.Conflict
+
+	updated, newLock, err := eval.Eval(dir, updatedSpec, lock)
+	if err != nil {
+		return evalError(dir, err)
+	}
+
 	if flags.overwrite {
-		updated, err := eval.Eval(updatedSpec)
-		if err != nil {
-			return fmt.Errorf("could not eval local spec: %w", err)
+		if err := stageBase(dir, updated); err != nil {
+			return err
 		}
 		if err = destRW.Write(updated); err != nil {
 			return fmt.Errorf("failed to write files back to directory %s: %w", dir, err)
 		}
+		if err := commitBase(dir); err != nil {
+			return err
+		}
 		// fall through to writing the spec back
 	} else {
 
@@ -104,46 +159,55 @@ func (flags *updateFlags) run(cmd *cobra.Command, args []string) error {
 		//  - the resources as previously defined (`orig`)
 		//  - the resources as defined by the updated spec (`updated`)
 
-		// get the spec as it is in HEAD
-		repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{
-			DetectDotGit: true,
-		})
-		if err != nil {
-			fmt.Fprintf(os.Stderr, `
-If this is not a git repo, use --overwrite to overwrite
-files rather than merging.
-`)
-			return fmt.Errorf("expected git repo at %s: %w", dir, err)
-		}
-		origSpec, err := getSpecFromGitRef(repo, flags.base, filepath.Join(dir, Spresmfile))
-		if err != nil {
-			fmt.Fprintf(os.Stderr, `
-Ref %q does not exist; if there is no spec
-committed, you can use --overwrite to overwrite
-files rather than merging.
-`)
-			return fmt.Errorf("could not get spec from git repo ref %q: %w", flags.base, err)
+		orig, err := readBase(dir)
+		switch {
+		case err == nil && !cmd.Flags().Changed("base"):
+			// use the resources recorded last time
+		case err == nil || os.IsNotExist(err):
+			// re-evaluate the spec as it was at the base ref
+			orig, err = evalSpecFromGitRef(dir, flags.base)
+			if err != nil {
+				return err
+			}
+		default:
+			return err
 		}
 
-		updated, err := eval.Eval(updatedSpec)
-		if err != nil {
-			return fmt.Errorf("could not eval local spec: %w", err)
-		}
-		orig, err := eval.Eval(origSpec)
-		if err != nil {
-			return fmt.Errorf("could not eval base spec: %w", err)
+		// the merge changes the local resources in place, so keep
+		// them as they were, in case the update is aborted
+		var before []*yaml.RNode
+		for _, node := range dest {
+			before = append(before, node.Copy())
 		}
 
-		merged, err := merge.Merge(dest, orig, updated)
+		var merged []*yaml.RNode
+		merged, conflicts, err = merge.Merge(dest, orig, updated)
 		if err != nil {
 			return err
 		}
+		if len(conflicts) > 0 {
+			// the base is recorded when the update is finished
+			if err := saveMergeState(dir, before, updated, conflicts); err != nil {
+				return err
+			}
+		} else if err := stageBase(dir, updated); err != nil {
+			return err
+		}
 		if err = destRW.Write(merged); err != nil {
 			return fmt.Errorf("failed to write merged files back to working directory: %w", err)
 		}
+		if len(conflicts) == 0 {
+			if err := commitBase(dir); err != nil {
+				return err
+			}
+		}
 		fmt.Fprintf(os.Stderr, "Merged files written to %s\n", dir)
 	}
 
+	if err := writeLock(dir, newLock); err != nil {
+		return err
+	}
+
 	if writeBackSpec {
 		if specPath, err := writeSpec(dir, updatedSpec); err != nil {
 			return err
@@ -151,9 +215,49 @@ files rather than merging.
 			fmt.Fprintf(os.Stderr, "Updated spec file written to %s\n", specPath)
 		}
 	}
+
+	if len(conflicts) > 0 {
+		fmt.Fprintf(os.Stderr, "\nThe update resulted in %d conflict(s).\n", len(conflicts))
+		state, err := loadMergeState(dir)
+		if err != nil {
+			return err
+		}
+		reportUnresolved(state)
+		return errUnresolved
+	}
 	return nil
 }
 
+// evalSpecFromGitRef evaluates the spec file in the package
+// directory as it is at the git ref given, to get the base for
+// merging when one has not been recorded.
+func evalSpecFromGitRef(dir, ref string) ([]*yaml.RNode, error) {
+	repo, err := git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{
+		DetectDotGit: true,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, `
+If this is not a git repo, use --overwrite to overwrite
+files rather than merging.
+`)
+		return nil, fmt.Errorf("expected git repo at %s: %w", dir, err)
+	}
+	origSpec, err := getSpecFromGitRef(repo, ref, filepath.Join(dir, Spresmfile))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, `
+Ref %q does not exist; if there is no spec
+committed, you can use --overwrite to overwrite
+files rather than merging.
+`, ref)
+		return nil, fmt.Errorf("could not get spec from git repo ref %q: %w", ref, err)
+	}
+	orig, _, err := eval.Eval(dir, origSpec, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not eval base spec: %w", err)
+	}
+	return orig, nil
+}
+
 func getSpecFromGitRef(repo *git.Repository, ref, path string) (spec.Spec, error) {
 	var spec spec.Spec
 
@@ -178,7 +282,7 @@ func getSpecFromGitRef(repo *git.Repository, ref, path string) (spec.Spec, error
 	}
 	reader, err := specFile.Blob.Reader()
 	if err != nil {
-		return spec, fmt.Errorf("could not open spec file blob: %w")
+		return spec, fmt.Errorf("could not open spec file blob: %w", err)
 	}
 	defer reader.Close()
 
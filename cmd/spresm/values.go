@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+
+	"github.com/squaremo/spresm/pkg/eval"
+	"github.com/squaremo/spresm/pkg/merge"
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// helmEditConfig gives the config to present when editing a chart
+// package: the Helm arguments, with the values shown in full. Where
+// possible, the values are the chart's own values.yaml with the
+// overrides applied in place, so that the documentation in its
+// comments, and the order of its keys, are kept.
+func helmEditConfig(helmArgs spec.HelmArgs, ch *chart.Chart) interface{} {
+	overrides := helmArgs.Values
+	helmArgs.Values = merge.ApplyOverrides(ch.Values, overrides)
+
+	var valuesFile []byte
+	for _, f := range ch.Raw {
+		if f.Name == chartutil.ValuesfileName {
+			valuesFile = f.Data
+			break
+		}
+	}
+	// an empty (or comment-only) values.yaml has no document
+	var doc yaml.Node
+	if valuesFile == nil || yaml.Unmarshal(valuesFile, &doc) != nil ||
+		doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return &helmArgs
+	}
+	values := doc.Content[0]
+	if err := merge.ApplyOverridesToNode(values, overrides); err != nil {
+		return &helmArgs
+	}
+
+	helmArgs.Values = nil
+	config, err := merge.EncodeNode(&helmArgs)
+	if err != nil {
+		return &helmArgs
+	}
+	for i := 0; i+1 < len(config.Content); i += 2 {
+		if config.Content[i].Value == "values" {
+			config.Content[i+1] = values
+		}
+	}
+	return config
+}
+
+// mergeChartValues does a three-way merge of the values in the
+// updated spec, between the defaults of the chart at the original
+// version and the defaults of the chart at the updated version, so
+// that values which weren't overridden follow the new defaults. Only
+// the overrides are kept in the spec.
+// Conflicts and removed values are reported, but don't stop the
+// update.
+func mergeChartValues(dir string, orig spec.Spec, updated *spec.Spec, lock *spec.Lock) error {
+	if updated.Helm == nil {
+		return nil
+	}
+	origChart, _, err := eval.LoadChart(dir, orig, lock)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not load chart at version %s to merge values (%s); values are left as they are\n", orig.Version, err)
+		return nil
+	}
+	updatedChart, _, err := eval.LoadChart(dir, *updated, nil)
+	if err != nil {
+		return err
+	}
+
+	// the spec only has overrides (or, if it predates that, the full
+	// values), so apply them to get the values actually used
+	mine := merge.ApplyOverrides(origChart.Values, updated.Helm.Values)
+	merged, changes := merge.MergeValues(mine, origChart.Values, updatedChart.Values)
+	helmArgs := *updated.Helm
+	helmArgs.Values = merge.Overrides(merged, updatedChart.Values)
+	updated.Helm = &helmArgs
+
+	if len(changes) > 0 {
+		fmt.Fprintf(os.Stderr, "Values changed in the chart from version %s to %s:\n", orig.Version, updated.Version)
+		for _, c := range changes {
+			fmt.Fprintf(os.Stderr, "  %s\n", c)
+		}
+	}
+	return nil
+}
+
+func newValuesCommand() *cobra.Command {
+	flags := &valuesFlags{}
+	cmd := &cobra.Command{
+		Use:   "values <dir> [--all|--overrides]",
+		Short: `show the values for the Helm chart package in <dir>`,
+		RunE:  flags.run,
+	}
+	flags.init(cmd)
+	return cmd
+}
+
+type valuesFlags struct {
+	all       bool
+	overrides bool
+}
+
+func (flags *valuesFlags) init(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&flags.all, "all", false, "show all the values, including the chart's defaults")
+	cmd.Flags().BoolVar(&flags.overrides, "overrides", false, "show only the values that differ from the chart's defaults (the default)")
+}
+
+func (flags *valuesFlags) run(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		return errors.New("values expects exactly one argument")
+	}
+	if flags.all && flags.overrides {
+		return errors.New("only one of --all and --overrides can be given")
+	}
+	dir := args[0]
+
+	s, err := getSpec(dir)
+	if err != nil {
+		return err
+	}
+	if s.Kind != spec.ChartKind || s.Helm == nil {
+		return fmt.Errorf("the package in %s is not a Helm chart", dir)
+	}
+	lock, err := getLock(dir)
+	if err != nil {
+		return err
+	}
+	chart, _, err := eval.LoadChart(dir, s, lock)
+	if err != nil {
+		return evalError(dir, err)
+	}
+
+	// even if the spec has only overrides, it may have been written
+	// before that was the case, so always work them out.
+	values := merge.ApplyOverrides(chart.Values, s.Helm.Values)
+	if !flags.all {
+		values = merge.Overrides(values, chart.Values)
+	}
+	return yaml.NewEncoder(os.Stdout).Encode(values)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+func editedValues(t *testing.T, valuesFile string, overrides map[string]interface{}) string {
+	ch := &chart.Chart{
+		Raw: []*chart.File{{Name: chartutil.ValuesfileName, Data: []byte(valuesFile)}},
+	}
+	assert.NoError(t, yaml.Unmarshal([]byte(valuesFile), &ch.Values))
+	helmArgs := spec.HelmArgs{Values: overrides}
+	out, err := yaml.Marshal(helmEditConfig(helmArgs, ch))
+	assert.NoError(t, err)
+	return string(out)
+}
+
+func TestHelmEditConfig(t *testing.T) {
+	// comments in the chart's values.yaml are kept
+	out := editedValues(t, "# replicas to run\nreplicas: 1\n", map[string]interface{}{"replicas": 3})
+	assert.Contains(t, out, "values:\n    # replicas to run\n    replicas: 3\n")
+
+	// an empty or comment-only values.yaml has no document to edit
+	for _, valuesFile := range []string{"", "# no values here\n"} {
+		out = editedValues(t, valuesFile, nil)
+		assert.Contains(t, out, "values: {}\n", valuesFile)
+		out = editedValues(t, valuesFile, map[string]interface{}{"replicas": 3, "name": "app"})
+		assert.Contains(t, out, "values:\n    name: app\n    replicas: 3\n", valuesFile)
+	}
+}
@@ -3,10 +3,15 @@ module github.com/squaremo/spresm
 go 1.14
 
 require (
+	github.com/Masterminds/semver/v3 v3.1.0
+	github.com/evanphx/json-patch v4.5.0+incompatible
 	github.com/go-git/go-git/v5 v5.2.0
 	github.com/spf13/cobra v1.0.0
 	github.com/stretchr/testify v1.6.1
+	github.com/xeipuuv/gojsonschema v1.2.0
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 	helm.sh/helm/v3 v3.3.4
+	sigs.k8s.io/kustomize/api v0.6.2
 	sigs.k8s.io/kustomize/kyaml v0.8.1
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -0,0 +1,340 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultIndexTTL is how long a repository index is used before it is
+// fetched again.
+const DefaultIndexTTL = 30 * time.Minute
+
+// ErrOffline is returned when something is not in the cache, and the
+// cache is not allowed to fetch it.
+var ErrOffline = errors.New("not in the cache, and working offline")
+
+const (
+	indexesDir  = "indexes"
+	archivesDir = "archives"
+	refsDir     = "refs"
+
+	indexFile = "index.yaml"
+	urlFile   = "url"
+)
+
+// Cache is an on-disk cache for Helm repository indexes and chart
+// archives. Archives are stored by their digest; the URLs they were
+// downloaded from are recorded separately, as refs to the digest.
+type Cache struct {
+	Dir string
+	// IndexTTL is how long an index is used before it's fetched again
+	IndexTTL time.Duration
+	// Offline means never fetch anything, only use what's cached
+	Offline bool
+}
+
+// DefaultDir gives the directory to use for the cache, respecting
+// $XDG_CACHE_HOME.
+func DefaultDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("could not determine cache directory: %w", err)
+	}
+	return filepath.Join(dir, "spresm"), nil
+}
+
+// New creates a cache using the directory given, with the default
+// TTL for indexes.
+func New(dir string) *Cache {
+	return &Cache{Dir: dir, IndexTTL: DefaultIndexTTL}
+}
+
+// Digest gives the digest by which content is stored in the cache.
+func Digest(content []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(content))
+}
+
+func keyFor(s string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(s)))
+}
+
+// Index returns the repository index for the repository URL given. A
+// cached copy is used if it's younger than the TTL, or if working
+// offline; otherwise, `fetch` is called to get the index, and the
+// result cached.
+func (c *Cache) Index(repoURL string, fetch func() ([]byte, error)) ([]byte, error) {
+	dir := filepath.Join(c.Dir, indexesDir, keyFor(repoURL))
+	path := filepath.Join(dir, indexFile)
+	if info, err := os.Stat(path); err == nil {
+		if c.Offline || time.Since(info.ModTime()) < c.IndexTTL {
+			return ioutil.ReadFile(path)
+		}
+	}
+	if c.Offline {
+		return nil, fmt.Errorf("index for %s: %w", repoURL, ErrOffline)
+	}
+
+	index, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, urlFile), []byte(repoURL), os.FileMode(0600)); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+func (c *Cache) archivePath(digest string) (string, error) {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || parts[1] == "" || strings.ContainsAny(parts[1], `/\.`) {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	return filepath.Join(c.Dir, archivesDir, parts[0], parts[1]+".tgz"), nil
+}
+
+// Archive returns the archive with the digest given, if it's in the
+// cache. If the archive is not found, it returns nil and no error.
+func (c *Cache) Archive(digest string) ([]byte, error) {
+	path, err := c.archivePath(digest)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// mark it as used, for the sake of pruning
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return content, nil
+}
+
+// ArchiveForURL returns the archive last downloaded from the URL
+// given, if it's in the cache; otherwise, `fetch` is called to get the
+// archive, and the result cached. If the digest of the archive is
+// known (e.g., from the repository index), it can be given to avoid
+// using an out of date ref.
+func (c *Cache) ArchiveForURL(url, digest string, fetch func() ([]byte, error)) ([]byte, error) {
+	if digest == "" {
+		digest, _ = c.ref(url)
+	}
+	if digest != "" {
+		content, err := c.Archive(digest)
+		if err != nil {
+			return nil, err
+		}
+		if content != nil {
+			return content, nil
+		}
+	}
+	if c.Offline {
+		return nil, fmt.Errorf("chart archive %s: %w", url, ErrOffline)
+	}
+
+	content, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.PutArchive(url, content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// PutArchive stores the archive given, recording it as having come
+// from the URL given. It returns the digest of the archive.
+func (c *Cache) PutArchive(url string, content []byte) (string, error) {
+	digest := Digest(content)
+	path, err := c.archivePath(digest)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.FileMode(0700)); err != nil {
+		return "", err
+	}
+	if err := writeFileAtomic(path, content); err != nil {
+		return "", err
+	}
+	if url != "" {
+		if err := os.MkdirAll(filepath.Join(c.Dir, refsDir), os.FileMode(0700)); err != nil {
+			return "", err
+		}
+		ref := digest + "\n" + url + "\n"
+		if err := writeFileAtomic(filepath.Join(c.Dir, refsDir, keyFor(url)), []byte(ref)); err != nil {
+			return "", err
+		}
+	}
+	return digest, nil
+}
+
+// ref reads the ref for the URL given, returning the digest.
+func (c *Cache) ref(url string) (string, error) {
+	digest, _, err := readRef(filepath.Join(c.Dir, refsDir, keyFor(url)))
+	return digest, err
+}
+
+func readRef(path string) (string, string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", "", err
+	}
+	lines := strings.SplitN(string(content), "\n", 3)
+	if len(lines) < 2 {
+		return "", "", fmt.Errorf("malformed ref file %s", path)
+	}
+	return lines[0], lines[1], nil
+}
+
+// Entry describes something in the cache.
+type Entry struct {
+	// "index" or "archive"
+	Kind string
+	// the URL for an index; the digest for an archive
+	Key string
+	// the URLs from which an archive was downloaded
+	URLs    []string
+	Size    int64
+	ModTime time.Time
+	path    string
+}
+
+// List returns all the entries in the cache.
+func (c *Cache) List() ([]Entry, error) {
+	var entries []Entry
+
+	indexes, err := ioutil.ReadDir(filepath.Join(c.Dir, indexesDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, d := range indexes {
+		dir := filepath.Join(c.Dir, indexesDir, d.Name())
+		info, err := os.Stat(filepath.Join(dir, indexFile))
+		if err != nil {
+			continue // incomplete; ignore it
+		}
+		url, _ := ioutil.ReadFile(filepath.Join(dir, urlFile))
+		entries = append(entries, Entry{
+			Kind:    "index",
+			Key:     string(url),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			path:    dir,
+		})
+	}
+
+	urls := map[string][]string{}
+	refs, err := ioutil.ReadDir(filepath.Join(c.Dir, refsDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, r := range refs {
+		digest, url, err := readRef(filepath.Join(c.Dir, refsDir, r.Name()))
+		if err == nil {
+			urls[digest] = append(urls[digest], url)
+		}
+	}
+
+	algos, err := ioutil.ReadDir(filepath.Join(c.Dir, archivesDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, algo := range algos {
+		archives, err := ioutil.ReadDir(filepath.Join(c.Dir, archivesDir, algo.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range archives {
+			digest := algo.Name() + ":" + strings.TrimSuffix(a.Name(), ".tgz")
+			entries = append(entries, Entry{
+				Kind:    "archive",
+				Key:     digest,
+				URLs:    urls[digest],
+				Size:    a.Size(),
+				ModTime: a.ModTime(),
+				path:    filepath.Join(c.Dir, archivesDir, algo.Name(), a.Name()),
+			})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind > entries[j].Kind // indexes first
+		}
+		return entries[i].Key < entries[j].Key
+	})
+	return entries, nil
+}
+
+// Prune removes the entries that haven't been updated or used since
+// the time given, and returns the entries removed. Refs to archives
+// that are no longer present are also removed.
+func (c *Cache) Prune(before time.Time) ([]Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var pruned []Entry
+	for _, e := range entries {
+		if e.ModTime.Before(before) {
+			if err := os.RemoveAll(e.path); err != nil {
+				return pruned, err
+			}
+			pruned = append(pruned, e)
+		}
+	}
+
+	refs, err := ioutil.ReadDir(filepath.Join(c.Dir, refsDir))
+	if err != nil && !os.IsNotExist(err) {
+		return pruned, err
+	}
+	for _, r := range refs {
+		refPath := filepath.Join(c.Dir, refsDir, r.Name())
+		digest, _, err := readRef(refPath)
+		if err == nil {
+			var archivePath string
+			if archivePath, err = c.archivePath(digest); err == nil {
+				_, err = os.Stat(archivePath)
+			}
+		}
+		if err != nil {
+			if err := os.Remove(refPath); err != nil {
+				return pruned, err
+			}
+		}
+	}
+	return pruned, nil
+}
+
+// writeFileAtomic writes to a temporary file then renames it, so that
+// a partially written file is never seen.
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCache(t *testing.T) *Cache {
+	dir, err := ioutil.TempDir("", "spresm-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return New(dir)
+}
+
+func counter(content string, count *int) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		*count++
+		return []byte(content), nil
+	}
+}
+
+func TestIndexTTL(t *testing.T) {
+	c := newTestCache(t)
+	var fetched int
+	const url = "https://charts.example.com/"
+
+	index, err := c.Index(url, counter("first", &fetched))
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(index))
+
+	index, err = c.Index(url, counter("second", &fetched))
+	assert.NoError(t, err)
+	assert.Equal(t, "first", string(index))
+	assert.Equal(t, 1, fetched)
+
+	c.IndexTTL = 0
+	index, err = c.Index(url, counter("second", &fetched))
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(index))
+	assert.Equal(t, 2, fetched)
+}
+
+func TestOffline(t *testing.T) {
+	c := newTestCache(t)
+	c.Offline = true
+	var fetched int
+
+	_, err := c.Index("https://charts.example.com/", counter("index", &fetched))
+	assert.True(t, errors.Is(err, ErrOffline))
+	_, err = c.ArchiveForURL("https://charts.example.com/foo-1.0.0.tgz", "", counter("archive", &fetched))
+	assert.True(t, errors.Is(err, ErrOffline))
+	assert.Equal(t, 0, fetched)
+
+	// a stale index is still used when offline
+	c.Offline = false
+	c.IndexTTL = 0
+	_, err = c.Index("https://charts.example.com/", counter("index", &fetched))
+	assert.NoError(t, err)
+	c.Offline = true
+	index, err := c.Index("https://charts.example.com/", counter("new index", &fetched))
+	assert.NoError(t, err)
+	assert.Equal(t, "index", string(index))
+	assert.Equal(t, 1, fetched)
+}
+
+func TestArchive(t *testing.T) {
+	c := newTestCache(t)
+	var fetched int
+	const url = "https://charts.example.com/foo-1.0.0.tgz"
+
+	content, err := c.ArchiveForURL(url, "", counter("archive", &fetched))
+	assert.NoError(t, err)
+	assert.Equal(t, "archive", string(content))
+
+	// by URL
+	content, err = c.ArchiveForURL(url, "", counter("other", &fetched))
+	assert.NoError(t, err)
+	assert.Equal(t, "archive", string(content))
+	assert.Equal(t, 1, fetched)
+
+	// by digest
+	content, err = c.Archive(Digest([]byte("archive")))
+	assert.NoError(t, err)
+	assert.Equal(t, "archive", string(content))
+
+	// a digest that doesn't match what's cached for the URL means
+	// fetching again
+	content, err = c.ArchiveForURL(url, Digest([]byte("republished")), counter("republished", &fetched))
+	assert.NoError(t, err)
+	assert.Equal(t, "republished", string(content))
+	assert.Equal(t, 2, fetched)
+
+	content, err = c.Archive(Digest([]byte("missing")))
+	assert.NoError(t, err)
+	assert.Nil(t, content)
+
+	_, err = c.Archive("md5:abcdef")
+	assert.Error(t, err)
+}
+
+func TestPrune(t *testing.T) {
+	c := newTestCache(t)
+	var fetched int
+	_, err := c.Index("https://charts.example.com/", counter("index", &fetched))
+	assert.NoError(t, err)
+	_, err = c.ArchiveForURL("https://charts.example.com/foo-1.0.0.tgz", "", counter("archive", &fetched))
+	assert.NoError(t, err)
+
+	entries, err := c.List()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "index", entries[0].Kind)
+	assert.Equal(t, "https://charts.example.com/", entries[0].Key)
+	assert.Equal(t, "archive", entries[1].Kind)
+	assert.Equal(t, []string{"https://charts.example.com/foo-1.0.0.tgz"}, entries[1].URLs)
+
+	pruned, err := c.Prune(time.Now().Add(-time.Hour))
+	assert.NoError(t, err)
+	assert.Empty(t, pruned)
+
+	pruned, err = c.Prune(time.Now().Add(time.Second))
+	assert.NoError(t, err)
+	assert.Len(t, pruned, 2)
+	entries, err = c.List()
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// the ref was removed along with the archive, so this fetches
+	_, err = c.ArchiveForURL("https://charts.example.com/foo-1.0.0.tgz", "", counter("archive", &fetched))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, fetched)
+}
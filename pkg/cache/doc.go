@@ -0,0 +1,4 @@
+// This package implements a local, on-disk cache for things that are
+// downloaded when evaluating packages; specifically, Helm repository
+// indexes and chart archives.
+package cache
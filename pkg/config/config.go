@@ -0,0 +1,233 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/helmpath"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/yaml"
+)
+
+// EnvPrefix is the prefix for environment variables giving repository
+// settings. For a repository named "internal-charts", the username is
+// given by SPRESM_REPOSITORY_INTERNAL_CHARTS_USERNAME, and similarly
+// for PASSWORD, CERT_FILE, KEY_FILE, CA_FILE,
+// INSECURE_SKIP_TLS_VERIFY, and PLAIN_HTTP.
+const EnvPrefix = "SPRESM_REPOSITORY_"
+
+// Config is the user configuration for spresm.
+type Config struct {
+	Repositories []Repository `json:"repositories,omitempty"`
+	// defaults for rendering Helm charts, which can be overridden in
+	// a Spresmfile
+	Helm HelmDefaults `json:"helm,omitempty"`
+	// the container runtime used to evaluate images: docker (the
+	// default), podman or nerdctl
+	ContainerRuntime string `json:"containerRuntime,omitempty"`
+}
+
+// HelmDefaults gives defaults for rendering Helm charts.
+type HelmDefaults struct {
+	// the Kubernetes version to render charts for, e.g., "1.19"
+	KubeVersion string `json:"kubeVersion,omitempty"`
+	// API versions to make available to charts, in addition to the
+	// built-in versions, e.g., "networking.k8s.io/v1/Ingress"
+	APIVersions []string `json:"apiVersions,omitempty"`
+}
+
+// Repository gives the settings for accessing a chart repository. A
+// Spresmfile can refer to a repository by its name; otherwise, the
+// settings are used for any chart with the repository's URL.
+type Repository struct {
+	Name string `json:"name"`
+	URL  string `json:"url,omitempty"`
+
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+
+	CertFile              string `json:"certFile,omitempty"`
+	KeyFile               string `json:"keyFile,omitempty"`
+	CAFile                string `json:"caFile,omitempty"`
+	InsecureSkipTLSVerify bool   `json:"insecureSkipTLSVerify,omitempty"`
+	// for OCI registries, use HTTP rather than HTTPS
+	PlainHTTP bool `json:"plainHTTP,omitempty"`
+}
+
+// DefaultPath gives the path of the config file, respecting
+// $XDG_CONFIG_HOME.
+func DefaultPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", fmt.Errorf("could not determine config directory: %w", err)
+	}
+	return filepath.Join(dir, "spresm", "config.yaml"), nil
+}
+
+// HelmRepositoriesPath gives the path of Helm's repositories.yaml, as
+// Helm itself would find it.
+func HelmRepositoriesPath() string {
+	if path := os.Getenv("HELM_REPOSITORY_CONFIG"); path != "" {
+		return path
+	}
+	return helmpath.ConfigPath("repositories.yaml")
+}
+
+// Load reads the config file at the path given. A missing file is
+// treated as empty config.
+func Load(path string) (*Config, error) {
+	c := &Config{}
+	bytes, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(bytes, c); err != nil {
+		return nil, fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// AddHelmRepositories adds the repositories from the Helm
+// repositories file at the path given. Repositories already in the
+// config take precedence over those with the same name from Helm. A
+// missing file is ignored.
+func (c *Config) AddHelmRepositories(path string) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	file, err := repo.LoadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, e := range file.Repositories {
+		if _, ok := c.byName(e.Name); ok {
+			continue
+		}
+		c.Repositories = append(c.Repositories, Repository{
+			Name:                  e.Name,
+			URL:                   e.URL,
+			Username:              e.Username,
+			Password:              e.Password,
+			CertFile:              e.CertFile,
+			KeyFile:               e.KeyFile,
+			CAFile:                e.CAFile,
+			InsecureSkipTLSVerify: e.InsecureSkipTLSverify,
+		})
+	}
+	return nil
+}
+
+// HelmDefaults gives the defaults for rendering charts; it's safe to
+// call on a nil config.
+func (c *Config) HelmDefaults() HelmDefaults {
+	if c == nil {
+		return HelmDefaults{}
+	}
+	return c.Helm
+}
+
+// Runtime gives the name of the container runtime to use, if one is
+// set; it's safe to call on a nil config.
+func (c *Config) Runtime() string {
+	if c == nil {
+		return ""
+	}
+	return c.ContainerRuntime
+}
+
+func (c *Config) byName(name string) (Repository, bool) {
+	if c == nil {
+		return Repository{}, false
+	}
+	for _, r := range c.Repositories {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return Repository{}, false
+}
+
+func (c *Config) byURL(url string) (Repository, bool) {
+	if c == nil {
+		return Repository{}, false
+	}
+	for _, r := range c.Repositories {
+		if r.URL != "" && strings.TrimSuffix(r.URL, "/") == strings.TrimSuffix(url, "/") {
+			return r, true
+		}
+	}
+	return Repository{}, false
+}
+
+// Repository finds the settings for a chart repository. If a name is
+// given, the repository with that name is used; otherwise, the
+// repository with the URL given, if there is one. Settings in the
+// environment are applied on top. The second return value is false if
+// there are no settings for a named repository.
+func (c *Config) Repository(name, url string) (Repository, bool) {
+	var r Repository
+	var found bool
+	if name != "" {
+		r, found = c.byName(name)
+	} else {
+		r, found = c.byURL(url)
+	}
+	if r.Name == "" {
+		r.Name = name
+	}
+	if r.Name != "" && r.applyEnv() {
+		found = true
+	}
+	return r, found || name == ""
+}
+
+// applyEnv sets any fields given in the environment, and reports
+// whether there were any.
+func (r *Repository) applyEnv() bool {
+	prefix := EnvPrefix + envName(r.Name) + "_"
+	var any bool
+	for suffix, field := range map[string]*string{
+		"USERNAME":  &r.Username,
+		"PASSWORD":  &r.Password,
+		"CERT_FILE": &r.CertFile,
+		"KEY_FILE":  &r.KeyFile,
+		"CA_FILE":   &r.CAFile,
+	} {
+		if v, ok := os.LookupEnv(prefix + suffix); ok {
+			*field = v
+			any = true
+		}
+	}
+	for suffix, field := range map[string]*bool{
+		"INSECURE_SKIP_TLS_VERIFY": &r.InsecureSkipTLSVerify,
+		"PLAIN_HTTP":               &r.PlainHTTP,
+	} {
+		if v, ok := os.LookupEnv(prefix + suffix); ok {
+			*field = v == "true" || v == "1"
+			any = true
+		}
+	}
+	return any
+}
+
+// envName converts a repository name to the form used in environment
+// variables, i.e., upper case with anything other than letters and
+// digits replaced by underscores.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTemp(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "spresm-config-test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	return path
+}
+
+func TestLoadMissing(t *testing.T) {
+	conf, err := Load(filepath.Join(os.TempDir(), "does-not-exist", "config.yaml"))
+	assert.NoError(t, err)
+	assert.Empty(t, conf.Repositories)
+}
+
+func TestRepositoryLookup(t *testing.T) {
+	conf, err := Load(writeTemp(t, "config.yaml", `repositories:
+- name: museum
+  url: https://charts.example.com/museum
+  username: spresm
+  password: hunter2
+  caFile: /etc/ca.pem
+`))
+	assert.NoError(t, err)
+	assert.NoError(t, conf.AddHelmRepositories(writeTemp(t, "repositories.yaml", `apiVersion: ""
+repositories:
+- name: museum
+  url: https://elsewhere.example.com/
+  username: ignored
+- name: stable
+  url: https://charts.helm.sh/stable
+  certFile: /etc/cert.pem
+  keyFile: /etc/key.pem
+`)))
+
+	r, ok := conf.Repository("museum", "https://charts.example.com/other/")
+	assert.True(t, ok)
+	assert.Equal(t, "spresm", r.Username)
+	assert.Equal(t, "/etc/ca.pem", r.CAFile)
+
+	r, ok = conf.Repository("", "https://charts.example.com/museum/")
+	assert.True(t, ok)
+	assert.Equal(t, "museum", r.Name)
+
+	r, ok = conf.Repository("", "https://charts.helm.sh/stable/")
+	assert.True(t, ok)
+	assert.Equal(t, "/etc/cert.pem", r.CertFile)
+
+	// an unnamed repository needs no settings
+	r, ok = conf.Repository("", "https://unknown.example.com/")
+	assert.True(t, ok)
+	assert.Equal(t, Repository{}, r)
+
+	// .. but a named one does
+	_, ok = conf.Repository("unknown", "https://unknown.example.com/")
+	assert.False(t, ok)
+}
+
+func TestRepositoryEnv(t *testing.T) {
+	for k, v := range map[string]string{
+		"SPRESM_REPOSITORY_MUSEUM_PASSWORD":                         "from-env",
+		"SPRESM_REPOSITORY_PRIVATE_CHARTS_USERNAME":                 "bot",
+		"SPRESM_REPOSITORY_PRIVATE_CHARTS_INSECURE_SKIP_TLS_VERIFY": "true",
+	} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	conf := &Config{Repositories: []Repository{
+		{Name: "museum", URL: "https://charts.example.com/", Username: "spresm", Password: "hunter2"},
+	}}
+
+	r, ok := conf.Repository("museum", "")
+	assert.True(t, ok)
+	assert.Equal(t, "spresm", r.Username)
+	assert.Equal(t, "from-env", r.Password)
+
+	// also applies when found by URL
+	r, ok = conf.Repository("", "https://charts.example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "from-env", r.Password)
+
+	// the environment alone is enough, and works with a nil config
+	var nilConf *Config
+	r, ok = nilConf.Repository("private-charts", "https://private.example.com/")
+	assert.True(t, ok)
+	assert.Equal(t, "bot", r.Username)
+	assert.True(t, r.InsecureSkipTLSVerify)
+}
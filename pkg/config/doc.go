@@ -0,0 +1,4 @@
+// This package deals with the user's own configuration for spresm,
+// which is kept apart from Spresmfiles so that (for example)
+// credentials for chart repositories don't end up in a package.
+package config
@@ -0,0 +1,50 @@
+package eval
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/semver/v3"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// capabilities gives the capabilities to render the chart with,
+// according to the spec's Helm arguments and the user config. It's an
+// error if the chart declares a kubeVersion that the capabilities
+// don't satisfy, as it would be for `helm install`.
+func capabilities(ch *chart.Chart, helmArgs *spec.HelmArgs) (*chartutil.Capabilities, error) {
+	defaults := UserConfig.HelmDefaults()
+	caps := *chartutil.DefaultCapabilities
+
+	kubeVersion := helmArgs.KubeVersion
+	if kubeVersion == "" {
+		kubeVersion = defaults.KubeVersion
+	}
+	if kubeVersion != "" {
+		v, err := semver.NewVersion(kubeVersion)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse Kubernetes version %q: %w", kubeVersion, err)
+		}
+		caps.KubeVersion = chartutil.KubeVersion{
+			Version: "v" + v.String(),
+			Major:   fmt.Sprint(v.Major()),
+			Minor:   fmt.Sprint(v.Minor()),
+		}
+	}
+
+	if len(defaults.APIVersions) > 0 || len(helmArgs.APIVersions) > 0 {
+		var versions chartutil.VersionSet
+		versions = append(versions, caps.APIVersions...)
+		versions = append(versions, defaults.APIVersions...)
+		caps.APIVersions = append(versions, helmArgs.APIVersions...)
+	}
+
+	if constraint := ch.Metadata.KubeVersion; constraint != "" {
+		if !chartutil.IsCompatibleRange(constraint, caps.KubeVersion.Version) {
+			return nil, fmt.Errorf("chart requires kubeVersion %s, which is incompatible with Kubernetes %s", constraint, caps.KubeVersion.Version)
+		}
+	}
+	return &caps, nil
+}
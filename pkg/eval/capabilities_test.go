@@ -0,0 +1,70 @@
+package eval
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/squaremo/spresm/pkg/config"
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+func makeChartWithCapabilities(t *testing.T) string {
+	return writeFiles(t, map[string]string{
+		"Chart.yaml": "apiVersion: v2\nname: app\nversion: 0.1.0\nkubeVersion: '>=1.16.0-0'\n",
+		"templates/ingress.yaml": `{{- if .Capabilities.APIVersions.Has "networking.k8s.io/v1/Ingress" }}
+apiVersion: networking.k8s.io/v1
+{{- else }}
+apiVersion: networking.k8s.io/v1beta1
+{{- end }}
+kind: Ingress
+metadata:
+  name: app
+  annotations:
+    kube-version: {{ .Capabilities.KubeVersion.Version }}
+`,
+	})
+}
+
+func evalIngress(t *testing.T, s spec.Spec) (string, string) {
+	nodes, _, err := Eval("", s, nil)
+	if !assert.NoError(t, err) || !assert.Len(t, nodes, 1) {
+		return "", ""
+	}
+	meta, err := nodes[0].GetMeta()
+	assert.NoError(t, err)
+	return meta.APIVersion, meta.Annotations["kube-version"]
+}
+
+func TestEvalHelmChartCapabilities(t *testing.T) {
+	var s spec.Spec
+	s.Init(spec.ChartKind)
+	s.Source = makeChartWithCapabilities(t)
+
+	apiVersion, _ := evalIngress(t, s)
+	assert.Equal(t, "networking.k8s.io/v1beta1", apiVersion)
+
+	// defaults from the user config
+	UserConfig = &config.Config{Helm: config.HelmDefaults{
+		KubeVersion: "1.19",
+		APIVersions: []string{"networking.k8s.io/v1/Ingress"},
+	}}
+	t.Cleanup(func() { UserConfig = nil })
+	apiVersion, kubeVersion := evalIngress(t, s)
+	assert.Equal(t, "networking.k8s.io/v1", apiVersion)
+	assert.Equal(t, "v1.19.0", kubeVersion)
+
+	// .. overridden in the spec
+	s.Helm.KubeVersion = "v1.20.2"
+	_, kubeVersion = evalIngress(t, s)
+	assert.Equal(t, "v1.20.2", kubeVersion)
+
+	// the chart's kubeVersion constraint is checked
+	s.Helm.KubeVersion = "1.15"
+	_, _, err := Eval("", s, nil)
+	assert.Error(t, err)
+
+	s.Helm.KubeVersion = "not a version"
+	_, _, err = Eval("", s, nil)
+	assert.Error(t, err)
+}
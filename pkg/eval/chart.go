@@ -1,6 +1,7 @@
 package eval
 
 import (
+	"bytes"
 	"fmt"
 	"net/url"
 	"strings"
@@ -9,9 +10,48 @@ import (
 	"helm.sh/helm/v3/pkg/chart/loader"
 	"helm.sh/helm/v3/pkg/getter"
 	"helm.sh/helm/v3/pkg/repo"
+	k8syaml "sigs.k8s.io/yaml"
+
+	"github.com/squaremo/spresm/pkg/cache"
+	"github.com/squaremo/spresm/pkg/config"
+	"github.com/squaremo/spresm/pkg/spec"
 )
 
-func ProcureChart(repoAndChartURL, version string) (*chart.Chart, error) {
+// ProcureChart fetches and loads the chart at the URL given, with the
+// version given. The repository names the settings (credentials and
+// so on) to use from the user config; if it's empty, any settings for
+// the repository's URL are used. If the chart is local, it is loaded
+// from the path given, relative to the working directory.
+func ProcureChart(repoAndChartURL, version, repository string) (*chart.Chart, error) {
+	if IsLocalChart(repoAndChartURL) {
+		chart, _, err := loadLocalChart(LocalPath("", repoAndChartURL))
+		return chart, err
+	}
+	archive, err := FetchChartArchive(repoAndChartURL, version, repository)
+	if err != nil {
+		return nil, err
+	}
+	return loadChartArchive(archive)
+}
+
+// ChartDigest gives the digest of a chart archive, as recorded in a
+// lock.
+func ChartDigest(archive []byte) string {
+	return cache.Digest(archive)
+}
+
+func loadChartArchive(archive []byte) (*chart.Chart, error) {
+	chart, err := loader.LoadArchive(bytes.NewReader(archive))
+	if err != nil {
+		return nil, fmt.Errorf("could not load downloaded chart archive: %w", err)
+	}
+	return chart, nil
+}
+
+// FetchChartArchive downloads the archive for the chart at the URL
+// given, with the version given, using the cache if there is one. The
+// repository is as for ProcureChart.
+func FetchChartArchive(repoAndChartURL, version, repository string) ([]byte, error) {
 	u, err := url.Parse(repoAndChartURL)
 	if err != nil {
 		return nil, fmt.Errorf("unable to parse chart URL: %w", err)
@@ -23,9 +63,17 @@ func ProcureChart(repoAndChartURL, version string) (*chart.Chart, error) {
 	chartName := pathElements[len(pathElements)-1]
 	u.Path = u.Path[:len(u.Path)-len(chartName)]
 
-	// Now we expect the URL to be the Helm repository; do the magic to fetch the index.
-	// TODO: Respect the local cache, rather than downloading every time.
-	certFile, keyFile, caFile := "", "", ""
+	// Now we expect the URL to be the Helm repository.
+	repoURL := u.String()
+	settings, ok := UserConfig.Repository(repository, repoURL)
+	if !ok {
+		return nil, fmt.Errorf("no settings found for chart repository %q; it should be in the config file, Helm's repositories file, or the environment", repository)
+	}
+	if u.Scheme == OCIScheme {
+		u.Path += chartName
+		return fetchOCIChart(u, version, settings)
+	}
+
 	providers := getter.Providers{
 		getter.Provider{
 			Schemes: []string{"http", "https"},
@@ -35,24 +83,146 @@ func ProcureChart(repoAndChartURL, version string) (*chart.Chart, error) {
 	// ^ cargo culted from fluxcd/source-controller, I can't find
 	// where this is done in Helm itself.
 
-	downloadUrl, err := repo.FindChartInRepoURL(u.String(), chartName, version, certFile, keyFile, caFile, providers)
+	get, err := providers.ByScheme(u.Scheme)
+	if err != nil {
+		return nil, fmt.Errorf("could not find how to download chart: %w", err)
+	}
+	tlsOptions := []getter.Option{
+		getter.WithTLSClientConfig(settings.CertFile, settings.KeyFile, settings.CAFile),
+		getter.WithInsecureSkipVerifyTLS(settings.InsecureSkipTLSVerify),
+	}
+	options := append([]getter.Option{getter.WithURL(repoURL)}, tlsOptions...)
+	if settings.Username != "" || settings.Password != "" {
+		options = append(options, getter.WithBasicAuth(settings.Username, settings.Password))
+	}
+
+	indexBytes, err := cachedIndex(repoURL, func() ([]byte, error) {
+		indexURL, err := repo.ResolveReferenceURL(repoURL, "index.yaml")
+		if err != nil {
+			return nil, err
+		}
+		buf, err := get.Get(indexURL, options...)
+		if err != nil {
+			return nil, fmt.Errorf("looks like %q is not a valid chart repository or cannot be reached: %w", repoURL, err)
+		}
+		return buf.Bytes(), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not get repository index: %w", err)
+	}
+	index := &repo.IndexFile{}
+	if err := k8syaml.Unmarshal(indexBytes, index); err != nil {
+		return nil, fmt.Errorf("could not parse repository index for %s: %w", repoURL, err)
+	}
+	index.SortEntries()
+
+	chartVersion, err := index.Get(chartName, version)
+	if err != nil {
+		return nil, fmt.Errorf("chart %q version %q not found in %s repository", chartName, version, repoURL)
+	}
+	if len(chartVersion.URLs) == 0 {
+		return nil, fmt.Errorf("chart %q version %q has no downloadable URLs", chartName, version)
+	}
+	downloadURL, err := repo.ResolveReferenceURL(repoURL, chartVersion.URLs[0])
 	if err != nil {
 		return nil, fmt.Errorf("could not find chart download URL: %w", err)
 	}
 
-	get, err := providers.ByScheme(u.Scheme)
+	// the digest in the index is the hex SHA-256 of the archive, if
+	// it's given at all
+	var digest string
+	if chartVersion.Digest != "" {
+		digest = "sha256:" + chartVersion.Digest
+	}
+	// The credentials are for the repository, so they're only sent if
+	// the chart is downloaded from the same place; an index can point
+	// anywhere (e.g., a mirror). The TLS settings still apply, since a
+	// mirror may use the same CA. A getter keeps the options it's
+	// given, so a fresh one is needed.
+	sameOrigin, err := isSameOrigin(repoURL, downloadURL)
 	if err != nil {
-		return nil, fmt.Errorf("could not find how to download chart: %w", err)
+		return nil, fmt.Errorf("could not parse chart download URL: %w", err)
 	}
+	if !sameOrigin {
+		parsed, _ := url.Parse(downloadURL)
+		if get, err = providers.ByScheme(parsed.Scheme); err != nil {
+			return nil, fmt.Errorf("could not find how to download chart: %w", err)
+		}
+		options = append([]getter.Option{getter.WithURL(downloadURL)}, tlsOptions...)
+	}
+	return cachedArchive(downloadURL, digest, func() ([]byte, error) {
+		buf, err := get.Get(downloadURL, options...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download chart: %w", err)
+		}
+		return buf.Bytes(), nil
+	})
+}
 
-	buf, err := get.Get(downloadUrl)
+// isSameOrigin says whether the URLs given have the same scheme, host
+// and port.
+func isSameOrigin(a, b string) (bool, error) {
+	ua, err := url.Parse(a)
 	if err != nil {
-		return nil, fmt.Errorf("failed to download chart: %w", err)
+		return false, err
 	}
-	chart, err := loader.LoadArchive(buf)
+	ub, err := url.Parse(b)
 	if err != nil {
-		return nil, fmt.Errorf("could not load downloaded chart archive: %w", err)
+		return false, err
 	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) &&
+		strings.EqualFold(ua.Hostname(), ub.Hostname()) &&
+		urlPort(ua) == urlPort(ub), nil
+}
 
-	return chart, nil
+// urlPort gives the port of the URL given, or the default port for
+// its scheme if it doesn't have one.
+func urlPort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http":
+		return "80"
+	case "https":
+		return "443"
+	}
+	return ""
+}
+
+// UserConfig supplies the settings for chart repositories, and
+// defaults for rendering charts. If it's nil, only repository settings
+// from the environment are used.
+var UserConfig *config.Config
+
+// ChartCache is used to keep repository indexes and chart archives
+// between runs. If it's nil, they are downloaded every time.
+var ChartCache *cache.Cache
+
+func cachedIndex(repoURL string, fetch func() ([]byte, error)) ([]byte, error) {
+	if ChartCache == nil {
+		return fetch()
+	}
+	return ChartCache.Index(repoURL, fetch)
+}
+
+func cachedArchive(url, digest string, fetch func() ([]byte, error)) ([]byte, error) {
+	if ChartCache == nil {
+		return fetch()
+	}
+	return ChartCache.ArchiveForURL(url, digest, fetch)
+}
+
+// lockedArchive returns the chart archive recorded in the lock, if
+// the lock applies to the spec and the archive is in the cache;
+// otherwise nil.
+func lockedArchive(s spec.Spec, lock *spec.Lock) []byte {
+	if ChartCache == nil || !lock.AppliesTo(s) {
+		return nil
+	}
+	archive, err := ChartCache.Archive(lock.Digest)
+	if err != nil {
+		return nil
+	}
+	return archive
 }
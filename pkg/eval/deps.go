@@ -0,0 +1,154 @@
+package eval
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chart"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// resolveDependencies fetches the dependencies declared by the chart
+// that aren't bundled with it (in its charts/ directory), and adds
+// them to the chart. The version used for each is, in order of
+// preference: the version recorded in the spresm lock, if it applies;
+// the version in the chart's Chart.lock; or, the latest version
+// matching the dependency's version constraint.
+//
+// `chartDir` is the directory the chart was loaded from, for
+// resolving file:// dependencies; it's empty if the chart came from
+// an archive. The dependencies resolved are returned, to be recorded
+// in the lock.
+func resolveDependencies(ch *chart.Chart, chartDir string, lock *spec.Lock) ([]spec.DependencyLock, error) {
+	return resolveDependenciesAt("", ch, chartDir, lock)
+}
+
+func resolveDependenciesAt(prefix string, ch *chart.Chart, chartDir string, lock *spec.Lock) ([]spec.DependencyLock, error) {
+	var resolved []spec.DependencyLock
+	for _, dep := range ch.Metadata.Dependencies {
+		if isBundled(ch, dep) {
+			continue
+		}
+		name := prefix + dep.Name
+
+		version := dep.Version
+		if ch.Lock != nil {
+			for _, locked := range ch.Lock.Dependencies {
+				if locked.Name == dep.Name && locked.Repository == dep.Repository {
+					version = locked.Version
+					break
+				}
+			}
+		}
+		locked := lock.Dependency(name, dep.Repository)
+		if locked != nil {
+			version = locked.Version
+		}
+
+		sub, subDir, digest, err := fetchDependency(dep, version, chartDir, locked)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve dependency %q of chart %q: %w", dep.Name, ch.Name(), err)
+		}
+		// a file:// dependency is a local source, so its digest is
+		// recorded but not checked (see checkLock)
+		local := strings.HasPrefix(dep.Repository, fileScheme)
+		if locked != nil && locked.Digest != digest && !local {
+			return nil, &LockMismatchError{
+				Source:  dep.Repository + " " + dep.Name,
+				Version: version,
+				Locked:  locked.Digest,
+				Actual:  digest,
+			}
+		}
+
+		// the dependency may have its own dependencies to resolve
+		subResolved, err := resolveDependenciesAt(name+"/", sub, subDir, lock)
+		if err != nil {
+			return nil, err
+		}
+
+		ch.AddDependency(sub)
+		resolved = append(resolved, spec.DependencyLock{
+			Name:       name,
+			Repository: dep.Repository,
+			Version:    sub.Metadata.Version,
+			Digest:     digest,
+		})
+		resolved = append(resolved, subResolved...)
+	}
+	return resolved, nil
+}
+
+// isBundled says whether the dependency is already present in the
+// chart's charts/ directory.
+func isBundled(ch *chart.Chart, dep *chart.Dependency) bool {
+	for _, sub := range ch.Dependencies() {
+		if sub.Name() == dep.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchDependency gets the chart for a dependency at the version
+// given, returning the chart, the directory it was loaded from (if it
+// was local), and its digest. If the dependency is locked, the archive
+// may come from the cache.
+func fetchDependency(dep *chart.Dependency, version, chartDir string, locked *spec.DependencyLock) (*chart.Chart, string, string, error) {
+	repository := dep.Repository
+	switch {
+	case repository == "":
+		return nil, "", "", fmt.Errorf("no repository given, and not found in charts/")
+
+	case strings.HasPrefix(repository, fileScheme):
+		if chartDir == "" {
+			return nil, "", "", fmt.Errorf("file:// dependencies can only be resolved for charts in a directory")
+		}
+		path := LocalPath(chartDir, repository)
+		ch, digest, err := loadLocalChart(path)
+		if err != nil {
+			return nil, "", "", err
+		}
+		return ch, localChartDir(path), digest, nil
+	}
+
+	var archive []byte
+	if locked != nil && ChartCache != nil {
+		archive, _ = ChartCache.Archive(locked.Digest)
+	}
+	if archive == nil {
+		// a repository can be referred to by name, as "@name" or
+		// "alias:name"; otherwise it's a URL.
+		var repoName string
+		repoURL := repository
+		if strings.HasPrefix(repository, "@") || strings.HasPrefix(repository, "alias:") {
+			repoName = strings.TrimPrefix(strings.TrimPrefix(repository, "@"), "alias:")
+			settings, ok := UserConfig.Repository(repoName, "")
+			if !ok || settings.URL == "" {
+				return nil, "", "", fmt.Errorf("no URL found for chart repository %q", repoName)
+			}
+			repoURL = settings.URL
+		}
+		var err error
+		archive, err = FetchChartArchive(strings.TrimSuffix(repoURL, "/")+"/"+dep.Name, version, repoName)
+		if err != nil {
+			return nil, "", "", err
+		}
+	}
+	ch, err := loadChartArchive(archive)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return ch, "", ChartDigest(archive), nil
+}
+
+// localChartDir gives the path given if it's a chart directory, or
+// an empty string if it's an archive.
+func localChartDir(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return path
+	}
+	return ""
+}
@@ -0,0 +1,155 @@
+package eval
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// makeChartWithDependency creates a chart directory for a chart
+// "app", which depends on the chart "foo" in the repository given, and
+// another chart in a sibling directory. It returns the chart directory.
+func makeChartWithDependency(t *testing.T, repoURL string) string {
+	root := writeFiles(t, map[string]string{
+		"app/Chart.yaml": `apiVersion: v2
+name: app
+version: 0.1.0
+dependencies:
+- name: foo
+  version: ^1.0.0
+  repository: ` + repoURL + `
+  condition: foo.enabled
+- name: common
+  version: 0.1.0
+  repository: file://../common
+`,
+		"app/values.yaml": "foo:\n  enabled: true\n",
+		"app/templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+`,
+		"common/Chart.yaml": "apiVersion: v2\nname: common\nversion: 0.1.0\n",
+		"common/templates/secret.yaml": `apiVersion: v1
+kind: Secret
+metadata:
+  name: common
+`,
+	})
+	return filepath.Join(root, "app")
+}
+
+func TestEvalHelmChartDependencies(t *testing.T) {
+	server, _ := serveChartRepo(t, makeChartRepo(t))
+	chartDir := makeChartWithDependency(t, server.URL)
+
+	var s spec.Spec
+	s.Init(spec.ChartKind)
+	s.Source = chartDir
+	s.Helm.Release.Name = "rel"
+
+	nodes, lock, err := Eval("", s, nil)
+	assert.NoError(t, err)
+	var paths []string
+	for _, n := range nodes {
+		path, _, err := kioutil.GetFileAnnotations(n)
+		assert.NoError(t, err)
+		paths = append(paths, path)
+	}
+	assert.ElementsMatch(t, []string{
+		"cm.yaml",
+		filepath.Join("charts", "foo", "deployment.yaml"),
+		filepath.Join("charts", "common", "secret.yaml"),
+	}, paths)
+
+	if assert.Len(t, lock.Dependencies, 2) {
+		foo := lock.Dependency("foo", server.URL)
+		if assert.NotNil(t, foo) {
+			assert.Equal(t, "1.0.0", foo.Version)
+		}
+		assert.NotNil(t, lock.Dependency("common", "file://../common"))
+	}
+
+	// the condition is honoured
+	s.Helm.Values = map[string]interface{}{
+		"foo": map[string]interface{}{"enabled": false},
+	}
+	nodes, _, err = Eval("", s, lock)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 2)
+
+	// a locked dependency must have the same digest
+	lock.Dependency("foo", server.URL).Digest = "sha256:0000"
+	_, _, err = Eval("", s, lock)
+	assert.IsType(t, &LockMismatchError{}, err)
+}
+
+func TestEvalHelmChartLocalDependencyChanged(t *testing.T) {
+	server, _ := serveChartRepo(t, makeChartRepo(t))
+	chartDir := makeChartWithDependency(t, server.URL)
+
+	var s spec.Spec
+	s.Init(spec.ChartKind)
+	s.Source = chartDir
+	s.Helm.Release.Name = "rel"
+	_, lock, err := Eval("", s, nil)
+	assert.NoError(t, err)
+
+	// a file:// dependency is expected to change, so a different
+	// digest is recorded, rather than being a lock mismatch
+	secret := filepath.Join(chartDir, "..", "common", "templates", "secret.yaml")
+	assert.NoError(t, ioutil.WriteFile(secret, []byte(`apiVersion: v1
+kind: Secret
+metadata:
+  name: common-changed
+`), 0644))
+	nodes, newLock, err := Eval("", s, lock)
+	assert.NoError(t, err)
+	assert.NotEqual(t,
+		lock.Dependency("common", "file://../common").Digest,
+		newLock.Dependency("common", "file://../common").Digest)
+	var names []string
+	for _, n := range nodes {
+		meta, err := n.GetMeta()
+		assert.NoError(t, err)
+		names = append(names, meta.Name)
+	}
+	assert.Contains(t, names, "common-changed")
+}
+
+func TestOutputPath(t *testing.T) {
+	for filename, path := range map[string]string{
+		"app/templates/cm.yaml":                                "cm.yaml",
+		"app/templates/sub/cm.yaml":                            "sub/cm.yaml",
+		"app/charts/foo/templates/deployment.yaml":             "charts/foo/deployment.yaml",
+		"app/charts/foo/charts/bar/templates/templates/x.yaml": "charts/foo/charts/bar/templates/x.yaml",
+	} {
+		assert.Equal(t, filepath.FromSlash(path), outputPath("app", filename), filename)
+	}
+}
+
+func TestEvalHelmChartDependenciesChartLock(t *testing.T) {
+	server, _ := serveChartRepo(t, makeChartRepo(t))
+	chartDir := makeChartWithDependency(t, server.URL)
+
+	// Chart.lock pins a version that doesn't exist, so resolving
+	// fails, showing it's used in preference to the constraint
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(chartDir, "Chart.lock"), []byte(`dependencies:
+- name: foo
+  repository: `+server.URL+`
+  version: 1.0.5
+digest: sha256:0000
+generated: "2020-10-01T00:00:00Z"
+`), 0644))
+
+	var s spec.Spec
+	s.Init(spec.ChartKind)
+	s.Source = chartDir
+	_, _, err := Eval("", s, nil)
+	assert.Error(t, err)
+}
@@ -2,7 +2,9 @@ package eval
 
 import (
 	"errors"
+	"fmt"
 
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 
 	"github.com/squaremo/spresm/pkg/spec"
@@ -10,16 +12,109 @@ import (
 
 var ErrNotImplemented = errors.New("not implemented")
 
+// LockMismatchError is returned when the source named in a spec no
+// longer has the digest recorded in the lock for the spec.
+type LockMismatchError struct {
+	Source, Version string
+	Locked, Actual  string
+}
+
+func (e *LockMismatchError) Error() string {
+	return fmt.Sprintf("%s at version %s has digest %s, but the lock has %s", e.Source, e.Version, e.Actual, e.Locked)
+}
+
 // Eval takes a spec and runs it, to produce the YAML output. The
 // output is in a kyaml/kio collection, so that it can be output to
-// disk, further transformed, or merged with other output.
-func Eval(s spec.Spec) ([]*yaml.RNode, error) {
+// disk, further transformed, or merged with other output. The spec's
+// pipeline, if it has one, is applied to the output.
+//
+// If a lock is given, and it applies to the spec (i.e., it has the
+// same source and version), the digest of what is evaluated must
+// match the digest in the lock, or a *LockMismatchError is
+// returned. In any case, the lock for what was evaluated is
+// returned.
+//
+// The directory given is that of the package; sources that are local
+// paths are taken as relative to it.
+func Eval(dir string, s spec.Spec, lock *spec.Lock) ([]*yaml.RNode, *spec.Lock, error) {
+	nodes, newLock, err := evalSource(dir, s, lock, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The files resources are written to are decided before the
+	// pipeline, so that (for example) setting the namespace doesn't
+	// move them.
+	if err := defaultFileAnnotations(nodes); err != nil {
+		return nil, nil, err
+	}
+	return applyPipeline(dir, s, nodes, lock, newLock)
+}
+
+// documentsFile is the file that documents which aren't resources are
+// written to, when the source doesn't say otherwise.
+const documentsFile = "documents.yaml"
+
+// defaultFileAnnotations annotates the documents given that don't
+// already say where they are to be written with a path and index, so
+// they can be written to the package and matched when merging.
+// Resources get a file named for their kind and name, as kio would
+// give them; other documents go in documentsFile.
+func defaultFileAnnotations(nodes []*yaml.RNode) error {
+	for _, node := range nodes {
+		if node.YNode().Kind != yaml.MappingNode {
+			continue
+		}
+		if _, err := node.GetMeta(); err != yaml.ErrMissingMetadata {
+			continue
+		}
+		if path, _, _ := kioutil.GetFileAnnotations(node); path != "" {
+			continue
+		}
+		if err := node.PipeE(yaml.SetAnnotation(kioutil.PathAnnotation, documentsFile)); err != nil {
+			return err
+		}
+	}
+	return kioutil.DefaultPathAndIndexAnnotation("", nodes)
+}
+
+// evalSource evaluates the source of a spec, without its pipeline. If
+// input is not nil, it's given to functions as their input items.
+func evalSource(dir string, s spec.Spec, lock *spec.Lock, input []*yaml.RNode) ([]*yaml.RNode, *spec.Lock, error) {
 	switch s.Kind {
 	case spec.ImageKind:
-		return evalImage(s)
+		return evalImage(dir, s, lock, input)
 	case spec.ChartKind:
-		return evalHelmChart(s)
+		return evalHelmChart(dir, s, lock)
+	case spec.GitKind:
+		return evalGit(s, lock)
+	case spec.ExecKind:
+		return evalExec(dir, s, lock, input)
+	case spec.StarlarkKind:
+		return evalStarlark(dir, s, lock, input)
+	case spec.KustomizeKind:
+		return evalKustomize(dir, s, lock)
 	default:
-		return nil, ErrNotImplemented
+		return nil, nil, ErrNotImplemented
+	}
+}
+
+// checkLock verifies the digest given against the lock given, and
+// returns the lock to record for the evaluation.
+//
+// A remote source (a chart or image from a repository or registry, a
+// git commit, a script fetched by URL) is expected to have the same
+// contents whenever its version is the same, so it's checked against
+// the lock. A local source (a chart, kustomization, script or
+// executable on the filesystem) is expected to change underneath the
+// spec, so its digest is recorded with spec.NewLock, but not checked.
+func checkLock(s spec.Spec, lock *spec.Lock, digest string) (*spec.Lock, error) {
+	if lock.AppliesTo(s) && lock.Digest != digest {
+		return nil, &LockMismatchError{
+			Source:  s.Source,
+			Version: s.Version,
+			Locked:  lock.Digest,
+			Actual:  digest,
+		}
 	}
+	return spec.NewLock(s, digest), nil
 }
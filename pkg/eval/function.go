@@ -0,0 +1,165 @@
+package eval
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/kustomize/kyaml/fn/runtime/starlark"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/squaremo/spresm/pkg/cache"
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// evalExec evaluates a spec with the kind "Exec", meaning run a local
+// executable that reads a ResourceList on stdin and writes one to
+// stdout. The executable is run in the package directory. Its input
+// items are as for evalImage. The digest for the lock is the SHA-256
+// of the executable, which is a local source (see checkLock).
+func evalExec(dir string, s spec.Spec, lock *spec.Lock, input []*yaml.RNode) ([]*yaml.RNode, *spec.Lock, error) {
+	args := functionArgs(s)
+	path, err := executablePath(dir, s.Source)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read executable %s: %w", path, err)
+	}
+
+	in, err := encodeResourceList(dir, s, args.FunctionConfig, args.Items, input)
+	if err != nil {
+		return nil, nil, err
+	}
+	timeout, err := parseTimeout(args.Timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	cmd := exec.Command(path, args.Args...)
+	cmd.Dir = dir
+	cmd.Stdin = in
+	out, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = out, stderr
+	// The executable is killed along with anything it started, on
+	// timeout; otherwise, a process it started could keep its output
+	// open, and waiting for it would not finish.
+	setProcessGroup(cmd)
+	runErr := cmd.Start()
+	if runErr == nil {
+		done := make(chan error, 1)
+		go func() { done <- cmd.Wait() }()
+		select {
+		case runErr = <-done:
+		case <-time.After(timeout):
+			killProcessGroup(cmd)
+			<-done
+			return nil, nil, fmt.Errorf("executable %s did not finish within %s, and was stopped (the timeout can be changed in the function section of the Spresmfile)", s.Source, timeout)
+		}
+	}
+	nodes, err := readFunctionOutput("executable "+s.Source, out, stderr, runErr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nodes, spec.NewLock(s, cache.Digest(content)), nil
+}
+
+// executablePath finds the executable named in a spec. A bare name is
+// looked up in $PATH; otherwise, it's relative to the package
+// directory.
+func executablePath(dir, source string) (string, error) {
+	if !strings.ContainsRune(source, '/') && !strings.ContainsRune(source, filepath.Separator) {
+		path, err := exec.LookPath(source)
+		if err != nil {
+			return "", fmt.Errorf("could not find executable %s: %w", source, err)
+		}
+		return path, nil
+	}
+	// exec wants a path with a separator, to be sure not to look in
+	// $PATH; and since the command is run in the package directory,
+	// it had better be absolute.
+	return filepath.Abs(LocalPath(dir, source))
+}
+
+// evalStarlark evaluates a spec with the kind "Starlark", meaning run
+// a Starlark script in-process, with the ResourceList (with items as
+// for evalImage) available to it as `ctx.resource_list`. The script
+// is a file relative to the package directory, or an HTTP URL. The
+// digest for the lock is the SHA-256 of the script, which is checked
+// only for a URL (see checkLock).
+func evalStarlark(dir string, s spec.Spec, lock *spec.Lock, input []*yaml.RNode) ([]*yaml.RNode, *spec.Lock, error) {
+	args := functionArgs(s)
+	remote := strings.HasPrefix(s.Source, "http://") || strings.HasPrefix(s.Source, "https://")
+	var program []byte
+	var err error
+	if remote {
+		program, err = fetchScript(s.Source)
+	} else {
+		program, err = ioutil.ReadFile(LocalPath(dir, s.Source))
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read Starlark script %s: %w", s.Source, err)
+	}
+	digest := cache.Digest(program)
+	newLock := spec.NewLock(s, digest)
+	if remote {
+		if newLock, err = checkLock(s, lock, digest); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	in, err := encodeResourceList(dir, s, args.FunctionConfig, args.Items, input)
+	if err != nil {
+		return nil, nil, err
+	}
+	timeout, err := parseTimeout(args.Timeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter := &starlark.Filter{
+		Name:    filepath.Base(s.Source),
+		Program: string(program),
+	}
+	// The script can't be interrupted, so on timeout it's left to
+	// run (along with the goroutine running it) until it finishes or
+	// spresm exits, and the error says so; it's given its own output
+	// buffer, since it may yet write to it.
+	out := &bytes.Buffer{}
+	done := make(chan error, 1)
+	go func() { done <- filter.Run(in, out) }()
+	var runErr error
+	select {
+	case runErr = <-done:
+	case <-time.After(timeout):
+		return nil, nil, fmt.Errorf("Starlark script %s did not finish within %s; it cannot be stopped, so it is left running until it finishes or spresm exits (the timeout can be changed in the function section of the Spresmfile)", s.Source, timeout)
+	}
+	nodes, err := readFunctionOutput("Starlark script "+s.Source, out, &bytes.Buffer{}, runErr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nodes, newLock, nil
+}
+
+func fetchScript(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func functionArgs(s spec.Spec) *spec.FunctionArgs {
+	if s.Function == nil {
+		return &spec.FunctionArgs{}
+	}
+	return s.Function
+}
@@ -0,0 +1,127 @@
+package eval
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+func functionSpec(kind spec.Kind, source string) spec.Spec {
+	var s spec.Spec
+	s.Init(kind)
+	s.Source = source
+	s.Function.FunctionConfig = map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"data":       map[string]string{"foo": "bar"},
+	}
+	return s
+}
+
+func TestEvalExec(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"deployment.yaml": "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\n",
+		"echo.sh":         "#!/bin/sh\ncat\n",
+		"fail.sh":         "#!/bin/sh\necho \"no good: $1\" >&2\nexit 3\n",
+		"slow.sh":         "#!/bin/sh\nsleep 5\n",
+	})
+	for _, script := range []string{"echo.sh", "fail.sh", "slow.sh"} {
+		assert.NoError(t, os.Chmod(filepath.Join(dir, script), 0755))
+	}
+
+	s := functionSpec(spec.ExecKind, "./echo.sh")
+	s.Function.Items = spec.ImageItemsPackage
+	nodes, lock, err := Eval(dir, s, nil)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(lock.Digest, "sha256:"))
+	if assert.Len(t, nodes, 1) {
+		meta, err := nodes[0].GetMeta()
+		assert.NoError(t, err)
+		assert.Equal(t, "app", meta.Name)
+	}
+
+	s = functionSpec(spec.ExecKind, "fail.sh")
+	_, _, err = Eval(dir, s, nil) // not in $PATH
+	assert.Error(t, err)
+
+	s.Source = "./fail.sh"
+	s.Function.Args = []string{"reason"}
+	_, _, err = Eval(dir, s, nil)
+	var fnErr *FunctionError
+	if assert.True(t, errors.As(err, &fnErr)) {
+		assert.Equal(t, "no good: reason\n", fnErr.Stderr)
+	}
+
+	// the sleep is a child of the script, and keeps its output open
+	// unless it's killed along with it
+	s = functionSpec(spec.ExecKind, "./slow.sh")
+	s.Function.Timeout = "50ms"
+	start := time.Now()
+	_, _, err = Eval(dir, s, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "did not finish within 50ms")
+	}
+	assert.True(t, time.Since(start) < 4*time.Second)
+}
+
+func TestEvalStarlark(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"deployment.yaml": "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\n",
+		"label.star": `
+def run(items, data):
+  for item in items:
+    item["metadata"].setdefault("labels", {})["foo"] = data["foo"]
+
+run(ctx.resource_list["items"], ctx.resource_list["functionConfig"]["data"])
+`,
+		"invalid.star": `
+ctx.resource_list["results"] = [{"message": "not today", "severity": "error"}]
+`,
+		"slow.star": `
+def spin():
+  for i in range(10000000):
+    pass
+
+spin()
+`,
+	})
+
+	s := functionSpec(spec.StarlarkKind, "label.star")
+	s.Function.Items = spec.ImageItemsPackage
+	nodes, lock, err := Eval(dir, s, nil)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(lock.Digest, "sha256:"))
+	if assert.Len(t, nodes, 1) {
+		label, err := nodes[0].Pipe(yaml.Lookup("metadata", "labels", "foo"))
+		assert.NoError(t, err)
+		assert.Equal(t, "bar", label.YNode().Value)
+	}
+
+	// a local script is expected to change, so a different digest is
+	// not an error
+	lock.Digest = "sha256:abc"
+	_, _, err = Eval(dir, s, lock)
+	assert.NoError(t, err)
+
+	s.Source = "invalid.star"
+	_, _, err = Eval(dir, s, nil)
+	var fnErr *FunctionError
+	if assert.True(t, errors.As(err, &fnErr)) {
+		assert.Equal(t, "not today", fnErr.Results[0].Message)
+	}
+
+	s.Source = "slow.star"
+	s.Function.Timeout = "10ms"
+	_, _, err = Eval(dir, s, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "did not finish within 10ms; it cannot be stopped")
+	}
+}
@@ -0,0 +1,144 @@
+package eval
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// SplitGitSource splits a source of the form `<repo URL>//<path>`
+// into the repository URL and the path within the repository. If
+// there's no `//` separator (after any scheme), the path is empty,
+// meaning the root of the repository.
+func SplitGitSource(source string) (string, string) {
+	start := 0
+	if i := strings.Index(source, "://"); i > -1 {
+		start = i + len("://")
+	}
+	i := strings.Index(source[start:], "//")
+	if i < 0 {
+		return source, ""
+	}
+	i += start
+	return source[:i], strings.Trim(source[i+2:], "/")
+}
+
+// evalGit evaluates a spec with the kind "Git", meaning clone the
+// repository and read the YAML files from the path given. The digest
+// for the lock is the commit hash.
+func evalGit(s spec.Spec, lock *spec.Lock) ([]*yaml.RNode, *spec.Lock, error) {
+	commit, newLock, err := fetchGitCommit(s, lock)
+	if err != nil {
+		return nil, nil, err
+	}
+	_, subpath := SplitGitSource(s.Source)
+	tree, err := gitTree(commit, subpath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var result []*yaml.RNode
+	err = tree.Files().ForEach(func(f *object.File) error {
+		ext := path.Ext(f.Name)
+		if ext != ".yaml" && ext != ".yml" {
+			return nil
+		}
+		reader, err := f.Reader()
+		if err != nil {
+			return fmt.Errorf("could not read file %q: %w", f.Name, err)
+		}
+		defer reader.Close()
+		br := kio.ByteReader{
+			Reader: reader,
+			SetAnnotations: map[string]string{
+				kioutil.PathAnnotation: f.Name,
+			},
+		}
+		resources, err := br.Read()
+		if err != nil {
+			return fmt.Errorf("could not parse file %q: %w", f.Name, err)
+		}
+		result = append(result, resources...)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, newLock, nil
+}
+
+// fetchGitCommit clones the repository named in the source of the
+// spec given, and returns the commit for the version given, along
+// with the lock to record. The digest for the lock is the commit
+// hash, and must match the lock given.
+func fetchGitCommit(s spec.Spec, lock *spec.Lock) (*object.Commit, *spec.Lock, error) {
+	repoURL, _ := SplitGitSource(s.Source)
+
+	// No worktree is needed, since the files are read straight out
+	// of the commit.
+	repo, err := git.Clone(memory.NewStorage(), nil, &git.CloneOptions{
+		URL:  repoURL,
+		Tags: git.AllTags,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to clone git repository %s: %w", repoURL, err)
+	}
+
+	commit, err := resolveGitVersion(repo, s.Version)
+	if err != nil {
+		return nil, nil, err
+	}
+	newLock, err := checkLock(s, lock, commit.Hash.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return commit, newLock, nil
+}
+
+// gitTree gives the tree at the path given (or the root, if it's
+// empty) in the commit given.
+func gitTree(commit *object.Commit, subpath string) (*object.Tree, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("could not obtain tree for commit %s: %w", commit.Hash, err)
+	}
+	if subpath != "" {
+		tree, err = tree.Tree(subpath)
+		if err != nil {
+			return nil, fmt.Errorf("could not find path %q in commit %s: %w", subpath, commit.Hash, err)
+		}
+	}
+	return tree, nil
+}
+
+// resolveGitVersion finds the commit that the version given refers
+// to. The version may be a tag, a branch, or a (possibly
+// abbreviated) commit hash. Since branches in a clone are only
+// present as remote refs, these are tried as a fallback.
+func resolveGitVersion(repo *git.Repository, version string) (*object.Commit, error) {
+	if version == "" {
+		version = "HEAD"
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(version))
+	if err != nil {
+		hash, err = repo.ResolveRevision(plumbing.Revision(git.DefaultRemoteName + "/" + version))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve version %q as a tag, branch or commit: %w", version, err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, fmt.Errorf("could not get commit for version %q: %w", version, err)
+	}
+	return commit, nil
+}
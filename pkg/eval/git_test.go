@@ -0,0 +1,153 @@
+package eval
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+func TestSplitGitSource(t *testing.T) {
+	for _, c := range []struct {
+		source, repo, path string
+	}{
+		{"https://github.com/org/app.git//config", "https://github.com/org/app.git", "config"},
+		{"https://github.com/org/app.git", "https://github.com/org/app.git", ""},
+		{"file:///tmp/repo//deploy/base/", "file:///tmp/repo", "deploy/base"},
+		{"/tmp/repo//config", "/tmp/repo", "config"},
+	} {
+		repo, path := SplitGitSource(c.source)
+		assert.Equal(t, c.repo, repo, c.source)
+		assert.Equal(t, c.path, path, c.source)
+	}
+}
+
+// makeGitRepo creates a repository with a commit tagged v1 and a
+// later commit on the branch "next"; it returns the path to the
+// repository and the hash of the first commit.
+func makeGitRepo(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "spresm-git-test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	repo, err := git.PlainInit(dir, false)
+	assert.NoError(t, err)
+	wt, err := repo.Worktree()
+	assert.NoError(t, err)
+
+	commit := func(files map[string]string) string {
+		for name, content := range files {
+			path := filepath.Join(dir, name)
+			assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+			assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+			_, err := wt.Add(name)
+			assert.NoError(t, err)
+		}
+		hash, err := wt.Commit("commit", &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		})
+		assert.NoError(t, err)
+		return hash.String()
+	}
+
+	first := commit(map[string]string{
+		"README.md": "# not YAML\n",
+		"config/service.yaml": `apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+`,
+	})
+	_, err = repo.CreateTag("v1", plumbing.NewHash(first), nil)
+	assert.NoError(t, err)
+
+	assert.NoError(t, wt.Checkout(&git.CheckoutOptions{
+		Branch: "refs/heads/next",
+		Create: true,
+	}))
+	commit(map[string]string{
+		"config/apps/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: bar
+`,
+	})
+	return dir, first
+}
+
+func TestEvalGit(t *testing.T) {
+	dir, first := makeGitRepo(t)
+
+	for _, c := range []struct {
+		version string
+		paths   []string
+	}{
+		{"v1", []string{"service.yaml"}},
+		{first, []string{"service.yaml"}},
+		{first[:8], []string{"service.yaml"}},
+		{"next", []string{"apps/deployment.yaml", "service.yaml"}},
+	} {
+		var s spec.Spec
+		s.Init(spec.GitKind)
+		s.Source = "file://" + dir + "//config"
+		s.Version = c.version
+
+		nodes, lock, err := Eval("", s, nil)
+		if !assert.NoError(t, err, c.version) {
+			continue
+		}
+		assert.True(t, lock.AppliesTo(s))
+		var paths []string
+		for _, n := range nodes {
+			path, _, err := kioutil.GetFileAnnotations(n)
+			assert.NoError(t, err)
+			paths = append(paths, path)
+		}
+		assert.ElementsMatch(t, c.paths, paths, c.version)
+	}
+}
+
+func TestEvalGitBadVersion(t *testing.T) {
+	dir, _ := makeGitRepo(t)
+	var s spec.Spec
+	s.Init(spec.GitKind)
+	s.Source = "file://" + dir
+	s.Version = "v2"
+	_, _, err := Eval("", s, nil)
+	assert.Error(t, err)
+}
+
+func TestEvalGitLock(t *testing.T) {
+	dir, first := makeGitRepo(t)
+	var s spec.Spec
+	s.Init(spec.GitKind)
+	s.Source = "file://" + dir + "//config"
+	s.Version = "v1"
+
+	_, lock, err := Eval("", s, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, first, lock.Digest)
+
+	// the same lock is fine
+	_, _, err = Eval("", s, lock)
+	assert.NoError(t, err)
+
+	// a lock with a different digest is refused
+	lock.Digest = "0000000000000000000000000000000000000000"
+	_, _, err = Eval("", s, lock)
+	assert.IsType(t, &LockMismatchError{}, err)
+
+	// .. unless the version has changed since
+	s.Version = "next"
+	_, _, err = Eval("", s, lock)
+	assert.NoError(t, err)
+}
@@ -5,6 +5,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"helm.sh/helm/v3/pkg/chart"
 	"helm.sh/helm/v3/pkg/chartutil"
 	"helm.sh/helm/v3/pkg/engine"
 	"sigs.k8s.io/kustomize/kyaml/kio"
@@ -14,61 +15,199 @@ import (
 	"github.com/squaremo/spresm/pkg/spec"
 )
 
-// evalHelmChart evaluates a spec with the kind "HelmChart".
-func evalHelmChart(s spec.Spec) ([]*yaml.RNode, error) {
-	// The format expected here looks like a regular URL; everything
-	// up to the last path element is taken as the repository URL, and
-	// the last path element is taken as naming the chart.
-	repoAndChartURL := s.Source
-	chart, err := ProcureChart(repoAndChartURL, s.Version)
-	if err != nil {
-		return nil, err
-	}
-
+// evalHelmChart evaluates a spec with the kind "HelmChart". The
+// digest for the lock is the SHA-256 of the chart archive. Local
+// charts are resolved relative to the directory given.
+func evalHelmChart(dir string, s spec.Spec, lock *spec.Lock) ([]*yaml.RNode, *spec.Lock, error) {
 	helmArgs := s.Helm
 	if helmArgs == nil {
 		helmArgs = &spec.HelmArgs{}
 	}
 
+	chart, newLock, err := LoadChart(dir, s, lock)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := prepareValues(chart, helmArgs.Values); err != nil {
+		return nil, nil, err
+	}
+
+	caps, err := capabilities(chart, helmArgs)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Finally we have an actual chart.
-	// TODO use values, releaseOptions from the spec.
 	values, err := chartutil.ToRenderValues(chart, chartutil.Values(helmArgs.Values), chartutil.ReleaseOptions{
 		Name:      helmArgs.Release.Name,
 		Namespace: helmArgs.Release.Namespace,
-	}, nil)
+	}, caps)
 	if err != nil {
-		return nil, fmt.Errorf("could not create values for chart templates: %w", err)
+		return nil, nil, fmt.Errorf("could not create values for chart templates: %w", err)
 	}
 
 	rendered, err := engine.Render(chart, values)
 	if err != nil {
-		return nil, fmt.Errorf("failed to render chart: %w", err)
+		return nil, nil, fmt.Errorf("failed to render chart: %w", err)
 	}
 
-	var result []*yaml.RNode
-	basepath := filepath.Join(chart.Name(), "templates")
+	var templated []*yaml.RNode
 	for filename, src := range rendered {
 		// probably fine hack: ignore anything that's not YAMLish
-		if !(strings.HasSuffix(filename, ".yaml") || strings.HasSuffix(filename, ".yml")) {
+		if !isYAMLFile(filename) {
 			continue
 		}
+		resources, err := readRendered(chart.Name(), filename, src)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not parse output of template %q: %w", filename, err)
+		}
+		templated = append(templated, resources...)
+	}
+	templated, err = filterHooks(templated, helmArgs.Hooks)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// CRDs go first, since `helm install` would apply them before
+	// anything else.
+	var result []*yaml.RNode
+	if helmArgs.IncludeCRDs == nil || *helmArgs.IncludeCRDs {
+		for _, crd := range chart.CRDObjects() {
+			if !isYAMLFile(crd.Filename) {
+				continue
+			}
+			resources, err := readRendered(chart.Name(), crd.Filename, string(crd.File.Data))
+			if err != nil {
+				return nil, nil, fmt.Errorf("could not parse CRD file %q: %w", crd.Filename, err)
+			}
+			result = append(result, resources...)
+		}
+	}
+	result = append(result, templated...)
+	return result, newLock, nil
+}
 
-		// if this fails, just use the path as-is
-		path, err := filepath.Rel(basepath, filename)
+// outputPath gives the path at which to write the output of a
+// template, given the name of the top-level chart and the template
+// filename. Templates of the chart itself go at the top level, and
+// those of subcharts go under charts/<subchart>/, i.e., the templates/
+// directories are dropped.
+func outputPath(chartName, filename string) string {
+	parts := strings.Split(strings.TrimPrefix(filename, chartName+"/"), "/")
+	var path []string
+	for i, part := range parts {
+		if part == "templates" && (i == 0 || (i >= 2 && parts[i-2] == "charts")) {
+			continue
+		}
+		path = append(path, part)
+	}
+	return filepath.Join(path...)
+}
+
+func isYAMLFile(filename string) bool {
+	return strings.HasSuffix(filename, ".yaml") || strings.HasSuffix(filename, ".yml")
+}
+
+// readRendered parses the output of a template (or a file from the
+// chart), and annotates each resource with the path to write it to.
+func readRendered(chartName, filename, src string) ([]*yaml.RNode, error) {
+	br := kio.ByteReader{
+		Reader: strings.NewReader(src),
+		SetAnnotations: map[string]string{
+			kioutil.PathAnnotation: outputPath(chartName, filename),
+		},
+	}
+	return br.Read()
+}
+
+// LoadChart loads the chart named in the spec, including any
+// dependencies that aren't bundled with it, and returns it along with
+// the lock for what was loaded. The lock given is checked and used as
+// for Eval.
+func LoadChart(dir string, s spec.Spec, lock *spec.Lock) (*chart.Chart, *spec.Lock, error) {
+	var chart *chart.Chart
+	var chartDir string
+	var newLock *spec.Lock
+	if IsLocalChart(s.Source) {
+		// A local chart's digest stands in for its version (see
+		// LocalChartVersion), and isn't checked (see checkLock).
+		var digest string
+		var err error
+		path := LocalPath(dir, s.Source)
+		chart, digest, err = loadLocalChart(path)
 		if err != nil {
-			path = filename
+			return nil, nil, err
+		}
+		chartDir = localChartDir(path)
+		newLock = spec.NewLock(s, digest)
+	} else {
+		// The format expected here looks like a regular URL;
+		// everything up to the last path element is taken as the
+		// repository URL, and the last path element is taken as
+		// naming the chart.
+		repoAndChartURL := s.Source
+		var repository string
+		if s.Helm != nil {
+			repository = s.Helm.Repository
+		}
+
+		// if the chart recorded in the lock is in the cache, there's
+		// no need to go to the repository at all.
+		archive := lockedArchive(s, lock)
+		if archive == nil {
+			var err error
+			archive, err = FetchChartArchive(repoAndChartURL, s.Version, repository)
+			if err != nil {
+				return nil, nil, err
+			}
 		}
-		br := kio.ByteReader{
-			Reader: strings.NewReader(src),
-			SetAnnotations: map[string]string{
-				kioutil.PathAnnotation: path,
-			},
+		var err error
+		newLock, err = checkLock(s, lock, ChartDigest(archive))
+		if err != nil {
+			return nil, nil, err
 		}
-		resources, err := br.Read()
+		chart, err = loadChartArchive(archive)
 		if err != nil {
-			return nil, fmt.Errorf("could not parse output of template %q: %w", filename, err)
+			return nil, nil, err
 		}
-		result = append(result, resources...)
 	}
-	return result, nil
+
+	// Dependencies that aren't bundled with the chart are fetched
+	// now; the versions recorded in the lock are only used if the
+	// lock is for this chart version.
+	if !lock.AppliesTo(s) {
+		lock = nil
+	}
+	deps, err := resolveDependencies(chart, chartDir, lock)
+	if err != nil {
+		return nil, nil, err
+	}
+	newLock.Dependencies = deps
+	return chart, newLock, nil
+}
+
+// prepareValues processes the chart's dependencies according to the
+// values given, then checks the values against the chart's schema.
+func prepareValues(chart *chart.Chart, values map[string]interface{}) error {
+	// this enables and disables dependencies according to their
+	// conditions and tags, and imports values from them.
+	if err := chartutil.ProcessDependencies(chart, chartutil.Values(values)); err != nil {
+		return fmt.Errorf("could not process chart dependencies: %w", err)
+	}
+	return ValidateValues(chart, values)
+}
+
+// CheckValues loads the chart named in the spec and checks the values
+// in the spec against the chart's schema. If they don't conform, the
+// error is a *ValuesError.
+func CheckValues(dir string, s spec.Spec, lock *spec.Lock) error {
+	chart, _, err := LoadChart(dir, s, lock)
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if s.Helm != nil {
+		values = s.Helm.Values
+	}
+	return prepareValues(chart, values)
 }
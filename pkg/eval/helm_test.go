@@ -0,0 +1,307 @@
+package eval
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	"helm.sh/helm/v3/pkg/provenance"
+	"helm.sh/helm/v3/pkg/repo"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/squaremo/spresm/pkg/cache"
+	"github.com/squaremo/spresm/pkg/config"
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// makeChartRepo creates a directory containing a chart repository,
+// with a chart "foo" at version 1.0.0; it returns the directory.
+func makeChartRepo(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "spresm-chart-test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	ch := &chart.Chart{
+		Metadata: &chart.Metadata{
+			APIVersion: chart.APIVersionV2,
+			Name:       "foo",
+			Version:    "1.0.0",
+		},
+		Values: map[string]interface{}{
+			"replicas": 1,
+		},
+		Templates: []*chart.File{
+			{
+				Name: "templates/deployment.yaml",
+				Data: []byte(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ .Release.Name }}
+spec:
+  replicas: {{ .Values.replicas }}
+`),
+			},
+			{
+				Name: "templates/NOTES.txt",
+				Data: []byte("not YAML\n"),
+			},
+		},
+	}
+	archive, err := chartutil.Save(ch, dir)
+	assert.NoError(t, err)
+	digest, err := provenance.DigestFile(archive)
+	assert.NoError(t, err)
+
+	index := repo.NewIndexFile()
+	index.Add(ch.Metadata, filepath.Base(archive), "", digest)
+	assert.NoError(t, index.WriteFile(filepath.Join(dir, "index.yaml"), 0644))
+	return dir
+}
+
+// serveChartRepo serves the directory given over HTTP, counting the
+// requests made.
+func serveChartRepo(t *testing.T, dir string) (*httptest.Server, *int) {
+	var requests int
+	files := http.FileServer(http.Dir(dir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func chartSpec(url string) spec.Spec {
+	var s spec.Spec
+	s.Init(spec.ChartKind)
+	s.Source = url + "/foo"
+	s.Version = "1.0.0"
+	s.Helm.Release.Name = "bar"
+	s.Helm.Values = map[string]interface{}{"replicas": 3}
+	return s
+}
+
+func TestEvalHelmChart(t *testing.T) {
+	server, _ := serveChartRepo(t, makeChartRepo(t))
+	s := chartSpec(server.URL)
+
+	nodes, lock, err := Eval("", s, nil)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(lock.Digest, "sha256:"))
+	if assert.Len(t, nodes, 1) {
+		meta, err := nodes[0].GetMeta()
+		assert.NoError(t, err)
+		assert.Equal(t, "bar", meta.Name)
+		replicas, err := nodes[0].Pipe(yaml.Lookup("spec", "replicas"))
+		assert.NoError(t, err)
+		assert.Equal(t, "3", replicas.YNode().Value)
+	}
+
+	s.Version = "2.0.0"
+	_, _, err = Eval("", s, nil)
+	assert.Error(t, err)
+}
+
+func TestEvalHelmChartCached(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spresm-cache-test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ChartCache = cache.New(dir)
+	t.Cleanup(func() { ChartCache = nil })
+
+	server, requests := serveChartRepo(t, makeChartRepo(t))
+	s := chartSpec(server.URL)
+
+	_, lock, err := Eval("", s, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, *requests) // index and archive
+
+	// the index and archive are both cached now
+	_, _, err = Eval("", s, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, *requests)
+
+	// with a lock, the archive is found by digest even when the
+	// repository can't be reached
+	server.Close()
+	ChartCache.Offline = true
+	_, _, err = Eval("", s, lock)
+	assert.NoError(t, err)
+
+	s.Version = "1.0.1"
+	_, _, err = Eval("", s, nil)
+	assert.Error(t, err)
+}
+
+// writeClientCert creates a self-signed client certificate and key in
+// the directory given, and returns their paths and the certificate.
+func writeClientCert(t *testing.T, dir string) (string, string, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "spresm"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile, keyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile, cert
+}
+
+func TestEvalHelmChartTLSAndAuth(t *testing.T) {
+	dir := makeChartRepo(t)
+	certDir, err := ioutil.TempDir("", "spresm-cert-test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(certDir) })
+	certFile, keyFile, clientCert := writeClientCert(t, certDir)
+
+	files := http.FileServer(http.Dir(dir))
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "spresm" || pass != "hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		files.ServeHTTP(w, r)
+	}))
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert)
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	caFile := filepath.Join(certDir, "ca.crt")
+	assert.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+
+	s := chartSpec(server.URL)
+	s.Helm.Repository = "museum"
+
+	// without settings for the named repository, it's an error
+	_, _, err = Eval("", s, nil)
+	assert.Error(t, err)
+
+	// with only the CA, the server refuses the connection
+	UserConfig = &config.Config{Repositories: []config.Repository{
+		{Name: "museum", CAFile: caFile},
+	}}
+	t.Cleanup(func() { UserConfig = nil })
+	_, _, err = Eval("", s, nil)
+	assert.Error(t, err)
+
+	// with the client cert, but no credentials, it's unauthorised
+	UserConfig.Repositories[0].CertFile = certFile
+	UserConfig.Repositories[0].KeyFile = keyFile
+	_, _, err = Eval("", s, nil)
+	assert.Error(t, err)
+
+	UserConfig.Repositories[0].Username = "spresm"
+	UserConfig.Repositories[0].Password = "hunter2"
+	nodes, _, err := Eval("", s, nil)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+
+	// the settings are also found by URL, when the repository isn't named
+	s.Helm.Repository = ""
+	UserConfig.Repositories[0].URL = server.URL
+	_, _, err = Eval("", s, nil)
+	assert.NoError(t, err)
+}
+
+func TestEvalHelmChartOtherHost(t *testing.T) {
+	dir := makeChartRepo(t)
+
+	// the archives are served from another host, which should not
+	// see the repository's credentials, but is trusted by way of the
+	// repository's CA
+	var authorized bool
+	files := http.FileServer(http.Dir(dir))
+	archives := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "" {
+			authorized = true
+		}
+		files.ServeHTTP(w, r)
+	}))
+	t.Cleanup(archives.Close)
+	caFile := filepath.Join(dir, "ca.crt")
+	assert.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: archives.Certificate().Raw}), 0600))
+
+	index, err := repo.LoadIndexFile(filepath.Join(dir, "index.yaml"))
+	assert.NoError(t, err)
+	for _, versions := range index.Entries {
+		for _, v := range versions {
+			v.URLs[0] = archives.URL + "/" + v.URLs[0]
+		}
+	}
+	indexDir, err := ioutil.TempDir("", "spresm-index-test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(indexDir) })
+	assert.NoError(t, index.WriteFile(filepath.Join(indexDir, "index.yaml"), 0644))
+
+	indexFiles := http.FileServer(http.Dir(indexDir))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "spresm" || pass != "hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		indexFiles.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	UserConfig = &config.Config{Repositories: []config.Repository{
+		{URL: server.URL, Username: "spresm", Password: "hunter2", CAFile: caFile},
+	}}
+	t.Cleanup(func() { UserConfig = nil })
+
+	nodes, _, err := Eval("", chartSpec(server.URL), nil)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+	assert.False(t, authorized)
+}
+
+func TestIsSameOrigin(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		same bool
+	}{
+		{"https://charts.example.com/", "https://charts.example.com/foo-1.0.0.tgz", true},
+		{"https://charts.example.com/", "https://charts.example.com:443/foo-1.0.0.tgz", true},
+		{"https://charts.example.com/", "http://charts.example.com/foo-1.0.0.tgz", false},
+		{"https://charts.example.com/", "https://charts.example.com:8443/foo-1.0.0.tgz", false},
+		{"https://charts.example.com/", "https://cdn.example.com/foo-1.0.0.tgz", false},
+	} {
+		same, err := isSameOrigin(c.a, c.b)
+		assert.NoError(t, err)
+		assert.Equal(t, c.same, same, c.b)
+	}
+}
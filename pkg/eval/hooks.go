@@ -0,0 +1,89 @@
+package eval
+
+import (
+	"fmt"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/release"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// LocalConfigAnnotation marks a resource as not to be applied to the
+// cluster.
+const LocalConfigAnnotation = "config.kubernetes.io/local-config"
+
+// defaultHookPolicy gives what `helm install` would do with a hook of
+// the type given: install hooks are run, and others are not.
+func defaultHookPolicy(hook string) spec.HookPolicy {
+	switch release.HookEvent(hook) {
+	case release.HookPreInstall, release.HookPostInstall:
+		return spec.HookInclude
+	default:
+		return spec.HookExclude
+	}
+}
+
+// hookPolicy gives the policy for a resource with the hook types
+// given, according to the policies given. If the resource is a hook
+// of more than one type, the most inclusive policy applies.
+func hookPolicy(hooks []string, policies map[string]spec.HookPolicy) (spec.HookPolicy, error) {
+	result := spec.HookExclude
+	for _, hook := range hooks {
+		policy, ok := policies[hook]
+		if !ok {
+			policy, ok = policies["*"]
+		}
+		if !ok {
+			policy = defaultHookPolicy(hook)
+		}
+		switch policy {
+		case spec.HookInclude:
+			return spec.HookInclude, nil
+		case spec.HookAnnotate:
+			result = spec.HookAnnotate
+		case spec.HookExclude:
+		default:
+			return "", fmt.Errorf("unknown hook policy %q for hook %q", policy, hook)
+		}
+	}
+	return result, nil
+}
+
+// filterHooks applies the hook policies given to the resources given,
+// returning those that remain.
+func filterHooks(nodes []*yaml.RNode, policies map[string]spec.HookPolicy) ([]*yaml.RNode, error) {
+	var result []*yaml.RNode
+	for _, n := range nodes {
+		meta, err := n.GetMeta()
+		if err != nil {
+			// not a resource, so not a hook either
+			result = append(result, n)
+			continue
+		}
+		annotation, ok := meta.Annotations[release.HookAnnotation]
+		if !ok {
+			result = append(result, n)
+			continue
+		}
+		var hooks []string
+		for _, hook := range strings.Split(annotation, ",") {
+			hooks = append(hooks, strings.TrimSpace(hook))
+		}
+		policy, err := hookPolicy(hooks, policies)
+		if err != nil {
+			return nil, err
+		}
+		switch policy {
+		case spec.HookInclude:
+			result = append(result, n)
+		case spec.HookAnnotate:
+			if err := n.PipeE(yaml.SetAnnotation(LocalConfigAnnotation, "true")); err != nil {
+				return nil, err
+			}
+			result = append(result, n)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,101 @@
+package eval
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+func makeChartWithHooks(t *testing.T) string {
+	return writeFiles(t, map[string]string{
+		"Chart.yaml": "apiVersion: v2\nname: app\nversion: 0.1.0\n",
+		"crds/crd.yaml": `apiVersion: apiextensions.k8s.io/v1
+kind: CustomResourceDefinition
+metadata:
+  name: widgets.example.com
+`,
+		"templates/cm.yaml": `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+`,
+		"templates/job.yaml": `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate
+  annotations:
+    helm.sh/hook: pre-install,pre-upgrade
+`,
+		"templates/tests/test.yaml": `apiVersion: v1
+kind: Pod
+metadata:
+  name: test
+  annotations:
+    helm.sh/hook: test
+`,
+	})
+}
+
+func evalKinds(t *testing.T, s spec.Spec) map[string]map[string]string {
+	nodes, _, err := Eval("", s, nil)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	kinds := map[string]map[string]string{}
+	for _, n := range nodes {
+		meta, err := n.GetMeta()
+		assert.NoError(t, err)
+		kinds[meta.Kind] = meta.Annotations
+	}
+	return kinds
+}
+
+func TestEvalHelmChartCRDsAndHooks(t *testing.T) {
+	var s spec.Spec
+	s.Init(spec.ChartKind)
+	s.Source = makeChartWithHooks(t)
+
+	// by default, as for helm install
+	kinds := evalKinds(t, s)
+	assert.Contains(t, kinds, "CustomResourceDefinition")
+	assert.Contains(t, kinds, "ConfigMap")
+	assert.Contains(t, kinds, "Job")
+	assert.NotContains(t, kinds, "Pod")
+
+	no := false
+	s.Helm.IncludeCRDs = &no
+	s.Helm.Hooks = map[string]spec.HookPolicy{
+		"test": spec.HookAnnotate,
+		"*":    spec.HookExclude,
+	}
+	kinds = evalKinds(t, s)
+	assert.NotContains(t, kinds, "CustomResourceDefinition")
+	assert.NotContains(t, kinds, "Job")
+	if assert.Contains(t, kinds, "Pod") {
+		assert.Equal(t, "true", kinds["Pod"][LocalConfigAnnotation])
+	}
+
+	s.Helm.Hooks = map[string]spec.HookPolicy{"test": "sometimes"}
+	_, _, err := Eval("", s, nil)
+	assert.Error(t, err)
+}
+
+func TestHookPolicy(t *testing.T) {
+	for _, c := range []struct {
+		hooks    []string
+		policies map[string]spec.HookPolicy
+		expected spec.HookPolicy
+	}{
+		{[]string{"post-install"}, nil, spec.HookInclude},
+		{[]string{"post-upgrade"}, nil, spec.HookExclude},
+		{[]string{"post-upgrade", "post-install"}, nil, spec.HookInclude},
+		{[]string{"test"}, map[string]spec.HookPolicy{"*": spec.HookInclude}, spec.HookInclude},
+		{[]string{"test", "pre-delete"}, map[string]spec.HookPolicy{"test": spec.HookAnnotate}, spec.HookAnnotate},
+	} {
+		policy, err := hookPolicy(c.hooks, c.policies)
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, policy, c.hooks)
+	}
+}
@@ -1,10 +1,11 @@
 package eval
 
 import (
-	//	"errors"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
-	"os/exec"
+	"time"
 
 	"sigs.k8s.io/kustomize/kyaml/kio"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
@@ -24,37 +25,186 @@ import (
 type ResourceList struct {
 	Kind           string      `yaml:"kind"`
 	FunctionConfig interface{} `yaml:"functionConfig"`
-	// this will always be empty, but what the heck.
-	Items []*yaml.RNode `yaml:"items"`
+	// empty, unless the spec asks for the package's resources. These
+	// are *yaml.Node rather than *yaml.RNode, since the latter
+	// doesn't encode as YAML.
+	Items []*yaml.Node `yaml:"items"`
 }
 
 // evalImage evaluates a spec with the kind "Image", meaning run an
-// image to generate the YAMLs.
-func evalImage(s spec.Spec) ([]*yaml.RNode, error) {
+// image to generate the YAMLs. The digest for the lock is the
+// image's repository digest (or its ID, if it has not been pushed to
+// a repository). The image is run with the container runtime given
+// by Runtime. If the spec asks for them, the resources in the
+// package directory given are passed to the image as input; or, if
+// input is not nil, those resources are passed instead.
+func evalImage(dir string, s spec.Spec, lock *spec.Lock, input []*yaml.RNode) ([]*yaml.RNode, *spec.Lock, error) {
 	image := s.Source
 	tag := s.Version
 	imageref := fmt.Sprintf("%s:%s", image, tag)
-	args := []string{"run", "--rm", "-i", imageref}
-	cmd := exec.Command("docker", args...)
+	runtime := containerRuntime()
+	digest, id, err := runtime.InspectImage(image, imageref)
+	if err != nil {
+		return nil, nil, err
+	}
+	newLock, err := checkLock(s, lock, digest)
+	if err != nil {
+		return nil, nil, err
+	}
 
+	// run the image by its ID, so it's definitely the one that was
+	// checked against the lock.
+	args := s.Image
+	if args == nil {
+		args = &spec.ImageArgs{}
+	}
+	in, err := encodeResourceList(dir, s, args.FunctionConfig, args.Items, input)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts, timeout, err := runOptions(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	out, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	runErr := runtime.Run(ctx, id, opts, in, out, stderr)
+	var stopErr *stopError
+	if errors.As(runErr, &stopErr) {
+		return nil, nil, fmt.Errorf("image %s did not finish within %s, and could not be stopped: %v", imageref, timeout, stopErr.kill)
+	}
+	if errors.Is(runErr, context.DeadlineExceeded) {
+		return nil, nil, fmt.Errorf("image %s did not finish within %s, and was stopped (the timeout can be changed in the image section of the Spresmfile)", imageref, timeout)
+	}
+	nodes, err := readFunctionOutput("image "+imageref, out, stderr, runErr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nodes, newLock, nil
+}
+
+// encodeResourceList gives the input for the function in the spec
+// given, with the functionConfig given, and the items asked for; or,
+// if input is not nil, with those as the items.
+func encodeResourceList(dir string, s spec.Spec, functionConfig interface{}, mode spec.ImageItems, input []*yaml.RNode) (*bytes.Buffer, error) {
+	var items []*yaml.Node
+	if input != nil {
+		items = toItems(input)
+	} else {
+		var err error
+		if items, err = functionItems(dir, mode, s.PipelineFiles()); err != nil {
+			return nil, err
+		}
+	}
 	in := &bytes.Buffer{}
 	// to debug: uncomment and use as arg to NewEncoder below
 	// tee := io.MultiWriter(in, os.Stderr)
-	input := &ResourceList{
+	list := &ResourceList{
 		Kind:           "ResourceList",
-		FunctionConfig: s.Image.FunctionConfig,
-		Items:          []*yaml.RNode{},
+		FunctionConfig: functionConfig,
+		Items:          items,
 	}
-	if err := yaml.NewEncoder(in).Encode(input); err != nil {
+	if err := yaml.NewEncoder(in).Encode(list); err != nil {
 		return nil, err
 	}
-	cmd.Stdin = in
+	return in, nil
+}
 
-	out := &bytes.Buffer{}
-	cmd.Stdout = out // no streaming for now (could use `StdoutPipe`)
-	if err := cmd.Run(); err != nil {
-		return nil, err
+// functionItems gives the items to pass to a function. The files
+// given are not read as part of the package.
+func functionItems(dir string, mode spec.ImageItems, exclude []string) ([]*yaml.Node, error) {
+	switch mode {
+	case "", spec.ImageItemsNone:
+		return []*yaml.Node{}, nil
+	case spec.ImageItemsPackage:
+		nodes, err := ReadPackage(dir, exclude...)
+		if err != nil {
+			return nil, fmt.Errorf("could not read package resources to pass to function: %w", err)
+		}
+		return toItems(nodes), nil
+	default:
+		return nil, fmt.Errorf("unknown value %q for items; expected %q or %q", mode, spec.ImageItemsNone, spec.ImageItemsPackage)
 	}
+}
+
+func toItems(nodes []*yaml.RNode) []*yaml.Node {
+	items := []*yaml.Node{}
+	for _, node := range nodes {
+		items = append(items, node.YNode())
+	}
+	return items
+}
+
+// readFunctionOutput reads the resources from the output of a
+// function, and reports any results in it. The function is described
+// by the name given, e.g., "image example.com/app:v1". If the function
+// failed, or reported errors, the error is a *FunctionError.
+func readFunctionOutput(name string, out, stderr *bytes.Buffer, runErr error) ([]*yaml.RNode, error) {
+	// A function that fails will usually still output a
+	// ResourceList, with results saying why; so read the output
+	// either way, but only complain about it if the function
+	// succeeded.
 	br := &kio.ByteReader{Reader: out}
-	return br.Read()
+	nodes, err := br.Read()
+	if err != nil && runErr == nil {
+		return nil, fmt.Errorf("could not read output of %s: %w", name, err)
+	}
+	results, err := parseResults(br.Results)
+	if err != nil && runErr == nil {
+		return nil, fmt.Errorf("could not read output of %s: %w", name, err)
+	}
+	if errs := reportResults(name, results); runErr != nil || len(errs) > 0 {
+		return nil, &FunctionError{
+			Function: name,
+			Results:  errs,
+			Stderr:   stderr.String(),
+			Err:      runErr,
+		}
+	}
+	return nodes, nil
+}
+
+// Defaults for running images, when not given in the spec.
+const (
+	defaultImageNetwork = "none"
+	defaultImageUser    = "65534:65534"
+	defaultImageCPUs    = "1"
+	defaultImageMemory  = "512m"
+	// this applies to executables too
+	defaultFunctionTimeout = 2 * time.Minute
+)
+
+// runOptions gives the options and timeout for running an image,
+// from the spec's image arguments and the defaults.
+func runOptions(args *spec.ImageArgs) (RunOptions, time.Duration, error) {
+	opts := RunOptions{
+		Network:        orDefault(args.Network, defaultImageNetwork),
+		ReadOnlyRootFS: args.ReadOnlyRootFilesystem == nil || *args.ReadOnlyRootFilesystem,
+		User:           orDefault(args.User, defaultImageUser),
+		CPUs:           orDefault(args.CPUs, defaultImageCPUs),
+		Memory:         orDefault(args.Memory, defaultImageMemory),
+	}
+	timeout, err := parseTimeout(args.Timeout)
+	return opts, timeout, err
+}
+
+// parseTimeout parses the timeout given for a function, defaulting
+// it if it's empty.
+func parseTimeout(timeout string) (time.Duration, error) {
+	if timeout == "" {
+		return defaultFunctionTimeout, nil
+	}
+	d, err := time.ParseDuration(timeout)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse timeout %q: %w", timeout, err)
+	}
+	return d, nil
+}
+
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
 }
@@ -0,0 +1,366 @@
+package eval
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// fakeImage is an image known to the fake runtime; run is called in
+// place of running a container.
+type fakeImage struct {
+	digest, id string
+	run        func(in io.Reader, out, errOut io.Writer) error
+}
+
+// fakeRuntime is a ContainerRuntime that runs functions rather than
+// containers, keyed by image ref.
+type fakeRuntime struct {
+	images map[string]fakeImage
+	runs   []string
+	opts   []RunOptions
+}
+
+func (r *fakeRuntime) InspectImage(image, imageref string) (string, string, error) {
+	img, ok := r.images[imageref]
+	if !ok {
+		return "", "", fmt.Errorf("could not pull image %s", imageref)
+	}
+	return img.digest, img.id, nil
+}
+
+func (r *fakeRuntime) Run(ctx context.Context, id string, opts RunOptions, in io.Reader, out, errOut io.Writer) error {
+	r.runs = append(r.runs, id)
+	r.opts = append(r.opts, opts)
+	for _, img := range r.images {
+		if img.id == id {
+			done := make(chan error, 1)
+			go func() { done <- img.run(in, out, errOut) }()
+			select {
+			case err := <-done:
+				return err
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+	return fmt.Errorf("no image with ID %s", id)
+}
+
+func useRuntime(t *testing.T, r ContainerRuntime) {
+	Runtime = r
+	t.Cleanup(func() { Runtime = nil })
+}
+
+// configMapGenerator reads the functionConfig from its input, and
+// outputs a ConfigMap with the same data.
+func configMapGenerator(in io.Reader, out, _ io.Writer) error {
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	input, err := yaml.Parse(string(b))
+	if err != nil {
+		return err
+	}
+	data, err := input.Pipe(yaml.Lookup("functionConfig", "data"))
+	if err != nil {
+		return err
+	}
+	cm := yaml.MustParse(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: generated
+`)
+	if err := cm.PipeE(yaml.SetField("data", data)); err != nil {
+		return err
+	}
+	return kio.ByteWriter{Writer: out}.Write([]*yaml.RNode{cm})
+}
+
+func imageSpec() spec.Spec {
+	var s spec.Spec
+	s.Init(spec.ImageKind)
+	s.Source = "example.com/generator"
+	s.Version = "v1"
+	s.Image.FunctionConfig = map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"data":       map[string]string{"foo": "bar"},
+	}
+	return s
+}
+
+func TestEvalImage(t *testing.T) {
+	runtime := &fakeRuntime{images: map[string]fakeImage{
+		"example.com/generator:v1": {
+			digest: "sha256:abc",
+			id:     "sha256:123",
+			run:    configMapGenerator,
+		},
+	}}
+	useRuntime(t, runtime)
+
+	s := imageSpec()
+	nodes, lock, err := Eval("", s, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:abc", lock.Digest)
+	assert.Equal(t, []string{"sha256:123"}, runtime.runs)
+	if assert.Len(t, nodes, 1) {
+		foo, err := nodes[0].Pipe(yaml.Lookup("data", "foo"))
+		assert.NoError(t, err)
+		assert.Equal(t, "bar", foo.YNode().Value)
+	}
+
+	// the digest must match a lock for the same version
+	lock.Digest = "sha256:def"
+	_, _, err = Eval("", s, lock)
+	assert.IsType(t, &LockMismatchError{}, err)
+
+	s.Version = "v2"
+	_, _, err = Eval("", s, nil)
+	assert.Error(t, err)
+}
+
+func TestEvalImageSandbox(t *testing.T) {
+	runtime := &fakeRuntime{images: map[string]fakeImage{
+		"example.com/generator:v1": {
+			digest: "sha256:abc",
+			id:     "sha256:123",
+			run:    configMapGenerator,
+		},
+		"example.com/slow:v1": {
+			digest: "sha256:def",
+			id:     "sha256:456",
+			run: func(in io.Reader, out, _ io.Writer) error {
+				time.Sleep(time.Second)
+				return nil
+			},
+		},
+	}}
+	useRuntime(t, runtime)
+
+	s := imageSpec()
+	_, _, err := Eval("", s, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, RunOptions{
+		Network:        "none",
+		ReadOnlyRootFS: true,
+		User:           "65534:65534",
+		CPUs:           "1",
+		Memory:         "512m",
+	}, runtime.opts[0])
+
+	writable := false
+	s.Image.Network = "bridge"
+	s.Image.ReadOnlyRootFilesystem = &writable
+	s.Image.User = "1000"
+	s.Image.Memory = "1g"
+	_, _, err = Eval("", s, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, RunOptions{
+		Network: "bridge",
+		User:    "1000",
+		CPUs:    "1",
+		Memory:  "1g",
+	}, runtime.opts[1])
+
+	s.Image.Timeout = "forever"
+	_, _, err = Eval("", s, nil)
+	assert.Error(t, err)
+
+	s.Source = "example.com/slow"
+	s.Image.Timeout = "10ms"
+	_, _, err = Eval("", s, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "did not finish within 10ms")
+	}
+}
+
+// labeller outputs the items from its input with a label added.
+func labeller(in io.Reader, out, _ io.Writer) error {
+	rw := &kio.ByteReadWriter{Reader: in, Writer: out}
+	nodes, err := rw.Read()
+	if err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if err := node.PipeE(yaml.SetLabel("labelled", "true")); err != nil {
+			return err
+		}
+	}
+	return rw.Write(nodes)
+}
+
+func TestEvalImageItems(t *testing.T) {
+	useRuntime(t, &fakeRuntime{images: map[string]fakeImage{
+		"example.com/labeller:v1": {
+			digest: "sha256:abc",
+			id:     "sha256:123",
+			run:    labeller,
+		},
+	}})
+
+	dir := writeFiles(t, map[string]string{
+		"deployment.yaml":     "apiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: app\n",
+		".spresm/base/a.yaml": "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: base\n",
+	})
+
+	s := imageSpec()
+	s.Source = "example.com/labeller"
+	nodes, _, err := Eval(dir, s, nil)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 0)
+
+	s.Image.Items = spec.ImageItemsPackage
+	nodes, _, err = Eval(dir, s, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, nodes, 1) {
+		meta, err := nodes[0].GetMeta()
+		assert.NoError(t, err)
+		assert.Equal(t, "app", meta.Name)
+		assert.Equal(t, "true", meta.Labels["labelled"])
+		assert.Equal(t, "deployment.yaml", meta.Annotations["config.kubernetes.io/path"])
+	}
+
+	s.Image.Items = "everything"
+	_, _, err = Eval(dir, s, nil)
+	assert.Error(t, err)
+}
+
+func TestEvalImageResults(t *testing.T) {
+	validator := func(output string, exit error) func(in io.Reader, out, errOut io.Writer) error {
+		return func(in io.Reader, out, errOut io.Writer) error {
+			io.WriteString(out, output)
+			io.WriteString(errOut, "validating ...\n")
+			return exit
+		}
+	}
+	useRuntime(t, &fakeRuntime{images: map[string]fakeImage{
+		"example.com/warn:v1": {
+			digest: "sha256:abc",
+			id:     "sha256:1",
+			run: validator(`apiVersion: config.kubernetes.io/v1
+kind: ResourceList
+items:
+- apiVersion: v1
+  kind: ConfigMap
+  metadata:
+    name: app
+results:
+- message: data is empty
+  severity: warning
+  resourceRef:
+    apiVersion: v1
+    kind: ConfigMap
+    name: app
+  field:
+    path: data
+`, nil),
+		},
+		"example.com/invalid:v1": {
+			digest: "sha256:def",
+			id:     "sha256:2",
+			// the format of results from older versions of kyaml
+			run: validator(`apiVersion: config.kubernetes.io/v1alpha1
+kind: ResourceList
+items: []
+results:
+  name: validator
+  items:
+  - message: replicas must be positive
+    severity: error
+    resourceRef:
+      apiVersion: apps/v1
+      kind: Deployment
+      metadata:
+        name: app
+        namespace: default
+    field:
+      path: spec.replicas
+  - message: looks fine otherwise
+    severity: info
+`, errors.New("exit status 1")),
+		},
+		"example.com/crash:v1": {
+			digest: "sha256:123",
+			id:     "sha256:3",
+			run:    validator("", errors.New("exit status 2")),
+		},
+	}})
+	log := &bytes.Buffer{}
+	Log = log
+	t.Cleanup(func() { Log = os.Stderr })
+
+	s := imageSpec()
+	s.Source = "example.com/warn"
+	nodes, _, err := Eval("", s, nil)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+	assert.Equal(t, "image example.com/warn:v1: warning: data is empty (v1 ConfigMap app, field data)\n", log.String())
+
+	log.Reset()
+	s.Source = "example.com/invalid"
+	_, _, err = Eval("", s, nil)
+	var fnErr *FunctionError
+	if assert.True(t, errors.As(err, &fnErr)) {
+		assert.Equal(t, []FunctionResult{{
+			Message:  "replicas must be positive",
+			Severity: SeverityError,
+			ResourceRef: ResourceRef{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Namespace:  "default",
+				Name:       "app",
+			},
+			Field: "spec.replicas",
+		}}, fnErr.Results)
+		assert.Contains(t, err.Error(), "error: replicas must be positive (apps/v1 Deployment default/app, field spec.replicas)")
+		assert.Contains(t, err.Error(), "validating ...")
+	}
+	assert.Equal(t, "image example.com/invalid:v1: info: looks fine otherwise\n", log.String())
+
+	s.Source = "example.com/crash"
+	_, _, err = Eval("", s, nil)
+	if assert.True(t, errors.As(err, &fnErr)) {
+		assert.Empty(t, fnErr.Results)
+		assert.Equal(t, "image example.com/crash:v1 failed: exit status 2\nstderr:\nvalidating ...", err.Error())
+	}
+}
+
+func TestRunArgs(t *testing.T) {
+	assert.Equal(t, []string{"run", "--rm", "-i", "--name", "spresm-1", "sha256:123"},
+		runArgs("spresm-1", "sha256:123", RunOptions{}))
+	assert.Equal(t, []string{"run", "--rm", "-i", "--name", "spresm-1",
+		"--network", "none", "--read-only", "--tmpfs", "/tmp", "--user", "65534:65534",
+		"--cpus", "1", "--memory", "512m", "sha256:123"},
+		runArgs("spresm-1", "sha256:123", RunOptions{
+			Network:        "none",
+			ReadOnlyRootFS: true,
+			User:           "65534:65534",
+			CPUs:           "1",
+			Memory:         "512m",
+		}))
+}
+
+func TestNewContainerRuntime(t *testing.T) {
+	for _, name := range RuntimeNames {
+		r, err := NewContainerRuntime(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, r.(*cliRuntime).command)
+	}
+	_, err := NewContainerRuntime("rkt")
+	assert.Error(t, err)
+}
@@ -0,0 +1,191 @@
+package eval
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"helm.sh/helm/v3/pkg/chart"
+	"sigs.k8s.io/kustomize/api/filesys"
+	"sigs.k8s.io/kustomize/api/konfig"
+	"sigs.k8s.io/kustomize/api/krusty"
+	"sigs.k8s.io/kustomize/api/types"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// IsLocalKustomization says whether the source given for a
+// kustomization is a directory on the local filesystem, rather than a
+// git repository. A git source has a scheme other than file://, is
+// an scp-style address like `git@github.com:org/app.git`, or has the
+// path within the repository appended after `//`.
+func IsLocalKustomization(source string) bool {
+	repo, _ := SplitGitSource(source)
+	return IsLocalChart(source) && !scpLikeURL.MatchString(source) && repo == source
+}
+
+// scpLikeURL matches the scp-style addresses git accepts for SSH,
+// `user@host:path`; the user is required, so that a local path with a
+// colon in it isn't mistaken for one.
+var scpLikeURL = regexp.MustCompile(`^[A-Za-z0-9_.-]+@[A-Za-z0-9_.-]+:`)
+
+// evalKustomize evaluates a spec with the kind "Kustomize", meaning
+// build the kustomization in the directory given as the source, as
+// `kustomize build` would. For a local directory, the digest is that
+// of its files; for a git repository, it's the commit hash. Only the
+// latter is checked against the lock (see checkLock).
+func evalKustomize(dir string, s spec.Spec, lock *spec.Lock) ([]*yaml.RNode, *spec.Lock, error) {
+	opts, err := kustomizeOptions(s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if IsLocalKustomization(s.Source) {
+		path := LocalPath(dir, s.Source)
+		digest, err := dirDigest(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read kustomization directory: %w", err)
+		}
+		nodes, err := buildKustomization(path, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nodes, spec.NewLock(s, digest), nil
+	}
+
+	commit, newLock, err := fetchGitCommit(s, lock)
+	if err != nil {
+		return nil, nil, err
+	}
+	tree, err := gitTree(commit, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	// The kustomization may refer to files elsewhere in the
+	// repository (e.g., a base in a sibling directory), so the whole
+	// commit is checked out.
+	checkout, err := ioutil.TempDir("", "spresm-kustomize")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(checkout)
+	if err := writeGitTree(tree, checkout); err != nil {
+		return nil, nil, err
+	}
+	_, subpath := SplitGitSource(s.Source)
+	nodes, err := buildKustomization(filepath.Join(checkout, filepath.FromSlash(subpath)), opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	return nodes, newLock, nil
+}
+
+// kustomizeOptions gives the options for building the kustomization
+// in the spec given.
+func kustomizeOptions(s spec.Spec) (*krusty.Options, error) {
+	opts := krusty.MakeDefaultOptions()
+	args := s.Kustomize
+	if args == nil {
+		return opts, nil
+	}
+	switch args.LoadRestrictor {
+	case "", spec.LoadRestrictorRootOnly:
+		opts.LoadRestrictions = types.LoadRestrictionsRootOnly
+	case spec.LoadRestrictorNone:
+		opts.LoadRestrictions = types.LoadRestrictionsNone
+	default:
+		return nil, fmt.Errorf("unknown load restrictor %q; expected %q or %q", args.LoadRestrictor, spec.LoadRestrictorRootOnly, spec.LoadRestrictorNone)
+	}
+	if args.EnablePlugins {
+		pluginConfig, err := konfig.EnabledPluginConfig(types.BploUseStaticallyLinked)
+		if err != nil {
+			return nil, fmt.Errorf("could not configure kustomize plugins: %w", err)
+		}
+		opts.PluginConfig = pluginConfig
+	}
+	opts.AddManagedbyLabel = args.AddManagedByLabel
+	return opts, nil
+}
+
+// buildKustomization runs kustomize on the directory given, and
+// parses the result.
+func buildKustomization(path string, opts *krusty.Options) ([]*yaml.RNode, error) {
+	resources, err := krusty.MakeKustomizer(filesys.MakeFsOnDisk(), opts).Run(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not build kustomization: %w", err)
+	}
+	out, err := resources.AsYaml()
+	if err != nil {
+		return nil, fmt.Errorf("could not serialise kustomize output: %w", err)
+	}
+	return (&kio.ByteReader{
+		Reader:                bytes.NewReader(out),
+		OmitReaderAnnotations: true,
+	}).Read()
+}
+
+// writeGitTree writes the files in the tree given to the directory
+// given, with their modes (so executable plugins stay executable).
+// Symlinks are refused, rather than written as regular files (which
+// would behave differently) or as links (which could point outside
+// the directory).
+func writeGitTree(tree *object.Tree, dir string) error {
+	return tree.Files().ForEach(func(f *object.File) error {
+		if f.Mode == filemode.Symlink {
+			return fmt.Errorf("%s is a symlink, which is not supported in a kustomization from git", f.Name)
+		}
+		mode, err := f.Mode.ToOSFileMode()
+		if err != nil {
+			return fmt.Errorf("file %q: %w", f.Name, err)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		reader, err := f.Reader()
+		if err != nil {
+			return fmt.Errorf("could not read file %q: %w", f.Name, err)
+		}
+		defer reader.Close()
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(file, reader)
+		return err
+	})
+}
+
+// dirDigest computes a digest over the files under the directory
+// given, in the same way as for a local chart directory.
+func dirDigest(root string) (string, error) {
+	var files []*chart.File
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, &chart.File{Name: name, Data: data})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return chartDirDigest(files), nil
+}
@@ -0,0 +1,182 @@
+package eval
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+var kustomizeFiles = map[string]string{
+	"base/kustomization.yaml": `resources:
+- deployment.yaml
+`,
+	"base/deployment.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: 1
+`,
+	"overlay/kustomization.yaml": `namePrefix: prod-
+resources:
+- ../base
+configMapGenerator:
+- name: settings
+  literals:
+  - foo=bar
+`,
+}
+
+func kustomizeSpec(source string) spec.Spec {
+	var s spec.Spec
+	s.Init(spec.KustomizeKind)
+	s.Source = source
+	return s
+}
+
+func resourceNames(t *testing.T, nodes []*yaml.RNode) []string {
+	var names []string
+	for _, node := range nodes {
+		meta, err := node.GetMeta()
+		assert.NoError(t, err)
+		names = append(names, meta.Name)
+	}
+	return names
+}
+
+func TestIsLocalKustomization(t *testing.T) {
+	for source, local := range map[string]bool{
+		"../base":                              true,
+		"/tmp/app/overlay":                     true,
+		"file:///tmp/app/overlay":              true,
+		"file:///tmp/repo//overlay":            false,
+		"https://github.com/org/app.git":       false,
+		"https://github.com/org/app.git//base": false,
+		"git@github.com:org/app.git//overlay":  false,
+		"git@github.com:org/app.git":           false,
+	} {
+		assert.Equal(t, local, IsLocalKustomization(source), source)
+	}
+}
+
+func TestEvalKustomizeLocal(t *testing.T) {
+	dir := writeFiles(t, kustomizeFiles)
+
+	s := kustomizeSpec("overlay")
+	nodes, lock, err := Eval(dir, s, nil)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(lock.Digest, "sha256:"))
+	names := resourceNames(t, nodes)
+	if assert.Len(t, names, 2) {
+		assert.Contains(t, names, "prod-app")
+		// generated names have a hash suffix
+		assert.True(t, strings.HasPrefix(names[0], "prod-settings-") || strings.HasPrefix(names[1], "prod-settings-"))
+	}
+
+	// a local kustomization is expected to change
+	lock.Digest = "sha256:abc"
+	_, _, err = Eval(dir, s, lock)
+	assert.NoError(t, err)
+
+	s.Kustomize.AddManagedByLabel = true
+	nodes, _, err = Eval(dir, s, nil)
+	assert.NoError(t, err)
+	assert.NotEqual(t, "", lookup(t, nodes[0], "metadata", "labels", "app.kubernetes.io/managed-by"))
+
+	s.Kustomize.LoadRestrictor = "sometimes"
+	_, _, err = Eval(dir, s, nil)
+	assert.Error(t, err)
+}
+
+func TestEvalKustomizeLoadRestrictor(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"shared/deployment.yaml": kustomizeFiles["base/deployment.yaml"],
+		"app/kustomization.yaml": `resources:
+- ../shared/deployment.yaml
+`,
+	})
+	s := kustomizeSpec("app")
+	_, _, err := Eval(dir, s, nil)
+	assert.Error(t, err)
+
+	s.Kustomize.LoadRestrictor = spec.LoadRestrictorNone
+	nodes, _, err := Eval(dir, s, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"app"}, resourceNames(t, nodes))
+}
+
+func TestEvalKustomizeGit(t *testing.T) {
+	dir := writeFiles(t, kustomizeFiles)
+	repo, err := git.PlainInit(dir, false)
+	assert.NoError(t, err)
+	wt, err := repo.Worktree()
+	assert.NoError(t, err)
+	assert.NoError(t, wt.AddGlob("."))
+	hash, err := wt.Commit("commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	assert.NoError(t, err)
+
+	s := kustomizeSpec("file://" + dir + "//overlay")
+	s.Version = hash.String()
+	nodes, lock, err := Eval("", s, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, hash.String(), lock.Digest)
+	assert.Contains(t, resourceNames(t, nodes), "prod-app")
+
+	lock.Digest = "0000000000000000000000000000000000000000"
+	_, _, err = Eval("", s, lock)
+	assert.IsType(t, &LockMismatchError{}, err)
+}
+
+func TestWriteGitTree(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"kustomization.yaml":  "generators:\n- plugin.yaml\n",
+		"plugins/generate.sh": "#!/bin/sh\n",
+	})
+	assert.NoError(t, os.Chmod(filepath.Join(dir, "plugins", "generate.sh"), 0755))
+	repo, err := git.PlainInit(dir, false)
+	assert.NoError(t, err)
+	wt, err := repo.Worktree()
+	assert.NoError(t, err)
+	commit := func() *object.Tree {
+		assert.NoError(t, wt.AddGlob("."))
+		hash, err := wt.Commit("commit", &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+		})
+		assert.NoError(t, err)
+		c, err := repo.CommitObject(hash)
+		assert.NoError(t, err)
+		tree, err := c.Tree()
+		assert.NoError(t, err)
+		return tree
+	}
+
+	// files keep their modes
+	checkout := writeFiles(t, nil)
+	assert.NoError(t, writeGitTree(commit(), checkout))
+	for name, mode := range map[string]os.FileMode{
+		"kustomization.yaml":  0644,
+		"plugins/generate.sh": 0755,
+	} {
+		info, err := os.Stat(filepath.Join(checkout, filepath.FromSlash(name)))
+		assert.NoError(t, err)
+		assert.Equal(t, mode, info.Mode().Perm(), name)
+	}
+
+	// symlinks are refused
+	assert.NoError(t, os.Symlink("kustomization.yaml", filepath.Join(dir, "link.yaml")))
+	err = writeGitTree(commit(), writeFiles(t, nil))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "link.yaml is a symlink")
+	}
+}
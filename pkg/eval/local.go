@@ -0,0 +1,89 @@
+package eval
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chart/loader"
+)
+
+const fileScheme = "file://"
+
+// IsLocalChart says whether the chart source given refers to a chart
+// on the local filesystem (a directory or a .tgz archive), i.e., it
+// is either a file:// URL or has no scheme at all.
+func IsLocalChart(source string) bool {
+	return strings.HasPrefix(source, fileScheme) || !strings.Contains(source, "://")
+}
+
+// LocalPath gives the filesystem path for a local source, be it a
+// chart, kustomization, script or executable. Relative paths are
+// taken as relative to the directory given, which is usually the
+// package directory.
+func LocalPath(dir, source string) string {
+	path := filepath.FromSlash(strings.TrimPrefix(source, fileScheme))
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// LocalChartVersion gives the effective version of the local chart
+// named by the source given, relative to the directory given. Since
+// a local chart can change without the version in its Chart.yaml
+// changing, this is the digest of its contents.
+func LocalChartVersion(dir, source string) (string, error) {
+	_, digest, err := loadLocalChart(LocalPath(dir, source))
+	return digest, err
+}
+
+// loadLocalChart loads the chart directory or archive at the path
+// given, and returns it along with a digest of its contents. For an
+// archive, the digest is that of the file, as for a downloaded
+// chart; for a directory, it is computed from the files in the chart
+// (respecting .helmignore).
+func loadLocalChart(path string) (*chart.Chart, string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not find local chart: %w", err)
+	}
+	if !info.IsDir() {
+		archive, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("could not read chart archive: %w", err)
+		}
+		ch, err := loadChartArchive(archive)
+		if err != nil {
+			return nil, "", err
+		}
+		return ch, ChartDigest(archive), nil
+	}
+
+	ch, err := loader.LoadDir(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("could not load chart from %s: %w", path, err)
+	}
+	return ch, chartDirDigest(ch.Raw), nil
+}
+
+// chartDirDigest computes a digest over the names and contents of the
+// files given, which doesn't depend on their order.
+func chartDirDigest(files []*chart.File) string {
+	sorted := make([]*chart.File, len(files))
+	copy(sorted, files)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Name < sorted[j].Name
+	})
+	h := sha256.New()
+	for _, f := range sorted {
+		fmt.Fprintf(h, "%s\x00%d\x00", filepath.ToSlash(f.Name), len(f.Data))
+		h.Write(f.Data)
+	}
+	return fmt.Sprintf("sha256:%x", h.Sum(nil))
+}
@@ -0,0 +1,95 @@
+package eval
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+func TestIsLocalChart(t *testing.T) {
+	for source, local := range map[string]bool{
+		"./charts/foo":                   true,
+		"../charts/foo-1.0.0.tgz":        true,
+		"/abs/charts/foo":                true,
+		"file:///abs/charts/foo":         true,
+		"https://charts.example.com/foo": false,
+		"oci://ghcr.io/org/charts/foo":   false,
+	} {
+		assert.Equal(t, local, IsLocalChart(source), source)
+	}
+	assert.Equal(t, "/abs/charts/foo", LocalPath("/pkg", "file:///abs/charts/foo"))
+	assert.Equal(t, filepath.Join("/repo", "charts", "foo"), LocalPath("/repo/deploy", "../charts/foo"))
+}
+
+func TestEvalLocalChart(t *testing.T) {
+	repoDir := makeChartRepo(t)
+	root, err := ioutil.TempDir("", "spresm-local-chart")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	chartDir := filepath.Join(root, "charts", "foo")
+	assert.NoError(t, os.MkdirAll(filepath.Join(chartDir, "templates"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(chartDir, "Chart.yaml"), []byte("apiVersion: v2\nname: foo\nversion: 0.1.0\n"), 0644))
+	template := []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: {{ .Release.Name }}\n")
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(chartDir, "templates", "cm.yaml"), template, 0644))
+	pkgDir := filepath.Join(root, "deploy", "app")
+	assert.NoError(t, os.MkdirAll(pkgDir, 0755))
+
+	var s spec.Spec
+	s.Init(spec.ChartKind)
+	s.Source = "../../charts/foo"
+	s.Helm.Release.Name = "app"
+
+	nodes, lock, err := Eval(pkgDir, s, nil)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+
+	// the digest doesn't change unless the chart does
+	_, lock2, err := Eval(pkgDir, s, lock)
+	assert.NoError(t, err)
+	assert.Equal(t, lock.Digest, lock2.Digest)
+	// .. and is the effective version of the chart
+	version, err := LocalChartVersion(pkgDir, s.Source)
+	assert.NoError(t, err)
+	assert.Equal(t, lock.Digest, version)
+
+	// .. and when it does, that's not a lock mismatch
+	changed := append(template, []byte("data:\n  foo: bar\n")...)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(chartDir, "templates", "cm.yaml"), changed, 0644))
+	_, lock3, err := Eval(pkgDir, s, lock)
+	assert.NoError(t, err)
+	assert.NotEqual(t, lock.Digest, lock3.Digest)
+	version, err = LocalChartVersion(pkgDir, s.Source)
+	assert.NoError(t, err)
+	assert.Equal(t, lock3.Digest, version)
+
+	// an archive is fine too, and has the same digest as it would
+	// if downloaded
+	archivePath := filepath.Join(repoDir, "foo-1.0.0.tgz")
+	archive, err := ioutil.ReadFile(archivePath)
+	assert.NoError(t, err)
+	s.Source = "file://" + archivePath
+	nodes, lock, err = Eval(pkgDir, s, nil)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+	assert.Equal(t, ChartDigest(archive), lock.Digest)
+}
+
+// writeFiles writes the files given, by path, into a temporary
+// directory, and returns the directory.
+func writeFiles(t *testing.T, files map[string]string) string {
+	root, err := ioutil.TempDir("", "spresm-eval-test")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(root) })
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	}
+	return root
+}
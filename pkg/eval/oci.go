@@ -0,0 +1,273 @@
+package eval
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/squaremo/spresm/pkg/cache"
+	"github.com/squaremo/spresm/pkg/config"
+)
+
+// OCIScheme is the URL scheme for charts kept in an OCI registry,
+// e.g., oci://ghcr.io/org/charts/app.
+const OCIScheme = "oci"
+
+const (
+	ociManifestMediaType = "application/vnd.oci.image.manifest.v1+json"
+	// the media type Helm uses for the chart archive layer; earlier
+	// (experimental) versions of Helm used the plain tar+gzip type.
+	ociChartLayerMediaType       = "application/vnd.cncf.helm.chart.content.v1.tar+gzip"
+	ociLegacyChartLayerMediaType = "application/tar+gzip"
+)
+
+type ociManifest struct {
+	MediaType string `json:"mediaType"`
+	Layers    []struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int64  `json:"size"`
+	} `json:"layers"`
+}
+
+// fetchOCIChart pulls the chart archive for the chart named by the
+// oci:// URL given, at the version given. The version is a tag, or a
+// manifest digest. This uses the registry HTTP API directly, since
+// Helm's registry client is not importable.
+func fetchOCIChart(chartURL *url.URL, version string, settings config.Repository) ([]byte, error) {
+	client, err := newOCIClient(chartURL.Host, settings)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.Trim(chartURL.Path, "/")
+	ref := chartURL.Host + "/" + name + ":" + version
+
+	var manifest ociManifest
+	if err := client.getJSON(name, "/manifests/"+version, ociManifestMediaType, &manifest); err != nil {
+		return nil, fmt.Errorf("could not get manifest for chart %s: %w", ref, err)
+	}
+	var digest string
+	for _, layer := range manifest.Layers {
+		if layer.MediaType == ociChartLayerMediaType || layer.MediaType == ociLegacyChartLayerMediaType {
+			digest = layer.Digest
+			break
+		}
+	}
+	if digest == "" {
+		return nil, fmt.Errorf("manifest for %s has no chart layer; is it a Helm chart?", ref)
+	}
+
+	// the layer digest is the digest of the chart archive, so it can
+	// be found in the cache without downloading anything else.
+	return cachedArchive(OCIScheme+"://"+ref, digest, func() ([]byte, error) {
+		blob, err := client.get(name, "/blobs/"+digest, "")
+		if err != nil {
+			return nil, fmt.Errorf("could not download chart %s: %w", ref, err)
+		}
+		if actual := cache.Digest(blob); actual != digest {
+			return nil, fmt.Errorf("chart layer for %s has digest %s, expected %s", ref, actual, digest)
+		}
+		return blob, nil
+	})
+}
+
+// ociClient makes requests to a registry, dealing with
+// authentication as it goes.
+type ociClient struct {
+	http     *http.Client
+	base     string
+	settings config.Repository
+	token    string
+}
+
+func newOCIClient(host string, settings config.Repository) (*ociClient, error) {
+	tlsConfig, err := tlsConfigFor(settings)
+	if err != nil {
+		return nil, err
+	}
+	scheme := "https"
+	if settings.PlainHTTP {
+		scheme = "http"
+	}
+	return &ociClient{
+		http: &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		base:     scheme + "://" + host + "/v2/",
+		settings: settings,
+	}, nil
+}
+
+func (c *ociClient) getJSON(name, path, accept string, out interface{}) error {
+	body, err := c.get(name, path, accept)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, out)
+}
+
+// get fetches the path given under the repository name given. If the
+// registry asks for a bearer token, one is obtained (using the
+// credentials in the settings, if there are any) and the request
+// tried again.
+func (c *ociClient) get(name, path, accept string) ([]byte, error) {
+	resp, err := c.do(c.base+name+path, accept)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && c.token == "" {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if err := c.authorize(challenge, name); err != nil {
+			return nil, err
+		}
+		if resp, err = c.do(c.base+name+path, accept); err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("registry responded %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (c *ociClient) do(u, accept string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	switch {
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.settings.Username != "" || c.settings.Password != "":
+		req.SetBasicAuth(c.settings.Username, c.settings.Password)
+	}
+	return c.http.Do(req)
+}
+
+// authorize gets a bearer token as directed by the challenge given,
+// per the Docker registry token authentication scheme.
+func (c *ociClient) authorize(challenge, name string) error {
+	scheme, params := parseChallenge(challenge)
+	if !strings.EqualFold(scheme, "bearer") || params["realm"] == "" {
+		return fmt.Errorf("registry refused access (challenge %q)", challenge)
+	}
+	q := url.Values{}
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + name + ":pull"
+	}
+	q.Set("scope", scope)
+
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+q.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if c.settings.Username != "" || c.settings.Password != "" {
+		req.SetBasicAuth(c.settings.Username, c.settings.Password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not get registry token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("could not get registry token: %s", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return fmt.Errorf("could not parse registry token: %w", err)
+	}
+	c.token = token.Token
+	if c.token == "" {
+		c.token = token.AccessToken
+	}
+	if c.token == "" {
+		return fmt.Errorf("registry gave an empty token")
+	}
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, e.g.,
+//
+//	Bearer realm="https://auth.example.com/token",service="registry"
+func parseChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(header), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		params[key] = value
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return parts[0], params
+}
+
+// tlsConfigFor constructs the TLS configuration given by the
+// repository settings.
+func tlsConfigFor(settings config.Repository) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: settings.InsecureSkipTLSVerify,
+	}
+	if settings.CertFile != "" && settings.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if settings.CAFile != "" {
+		ca, err := ioutil.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", settings.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
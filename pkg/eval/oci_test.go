@@ -0,0 +1,112 @@
+package eval
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/squaremo/spresm/pkg/cache"
+	"github.com/squaremo/spresm/pkg/config"
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// serveOCIRegistry serves the chart archive given as
+// charts/foo:1.0.0, from a registry that requires a bearer token, got
+// with the credentials spresm:hunter2.
+func serveOCIRegistry(t *testing.T, archive []byte) *httptest.Server {
+	digest := cache.Digest(archive)
+	manifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     ociManifestMediaType,
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.cncf.helm.config.v1+json",
+			"digest":    "sha256:0000",
+			"size":      2,
+		},
+		"layers": []map[string]interface{}{
+			{"mediaType": ociChartLayerMediaType, "digest": digest, "size": len(archive)},
+		},
+	})
+	assert.NoError(t, err)
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if user, pass, ok := r.BasicAuth(); !ok || user != "spresm" || pass != "hunter2" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token": "letmein"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer letmein" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/charts/foo/manifests/1.0.0", "/v2/charts/foo/manifests/" + cache.Digest(manifest):
+			w.Header().Set("Content-Type", ociManifestMediaType)
+			w.Write(manifest)
+		case "/v2/charts/foo/blobs/" + digest:
+			w.Write(archive)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestEvalHelmChartOCI(t *testing.T) {
+	archive, err := ioutil.ReadFile(filepath.Join(makeChartRepo(t), "foo-1.0.0.tgz"))
+	assert.NoError(t, err)
+	server := serveOCIRegistry(t, archive)
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var s spec.Spec
+	s.Init(spec.ChartKind)
+	s.Source = "oci://" + host + "/charts/foo"
+	s.Version = "1.0.0"
+	s.Helm.Release.Name = "bar"
+
+	UserConfig = &config.Config{Repositories: []config.Repository{
+		{Name: "registry", URL: "oci://" + host + "/charts", PlainHTTP: true},
+	}}
+	t.Cleanup(func() { UserConfig = nil })
+
+	// no credentials, so no token
+	_, _, err = Eval("", s, nil)
+	assert.Error(t, err)
+
+	UserConfig.Repositories[0].Username = "spresm"
+	UserConfig.Repositories[0].Password = "hunter2"
+	nodes, lock, err := Eval("", s, nil)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+	assert.Equal(t, cache.Digest(archive), lock.Digest)
+
+	s.Version = "2.0.0"
+	_, _, err = Eval("", s, nil)
+	assert.Error(t, err)
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.example.com/token",service="registry.example.com",scope="repository:charts/foo:pull"`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.example.com/token",
+		"service": "registry.example.com",
+		"scope":   "repository:charts/foo:pull",
+	}, params)
+
+	scheme, params = parseChallenge(`Basic realm=registry`)
+	assert.Equal(t, "Basic", scheme)
+	assert.Equal(t, "registry", params["realm"])
+}
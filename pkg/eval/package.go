@@ -0,0 +1,53 @@
+package eval
+
+import (
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// StateDir is the directory, within a package, in which spresm keeps
+// its own records. Files in it are not part of the package.
+const StateDir = ".spresm"
+
+// ReadPackage reads the resources in the package directory given,
+// leaving out spresm's own files, and the files given (e.g., those
+// used by the spec's pipeline). Each resource is annotated with the
+// path it was read from.
+func ReadPackage(dir string, exclude ...string) ([]*yaml.RNode, error) {
+	if dir == "" {
+		dir = "."
+	}
+	nodes, err := kio.LocalPackageReader{PackagePath: dir}.Read()
+	if err != nil {
+		return nil, err
+	}
+	var result []*yaml.RNode
+	for _, node := range nodes {
+		path, _, err := kioutil.GetFileAnnotations(node)
+		if err != nil {
+			return nil, err
+		}
+		if isStatePath(path) || isExcluded(path, exclude) {
+			continue
+		}
+		result = append(result, node)
+	}
+	return result, nil
+}
+
+func isStatePath(path string) bool {
+	return path == StateDir || strings.HasPrefix(filepath.ToSlash(path), StateDir+"/")
+}
+
+func isExcluded(path string, exclude []string) bool {
+	for _, e := range exclude {
+		if filepath.ToSlash(path) == e {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,311 @@
+package eval
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/filters"
+	"sigs.k8s.io/kustomize/kyaml/openapi"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+	"sigs.k8s.io/kustomize/kyaml/yaml/merge2"
+	k8syaml "sigs.k8s.io/yaml"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+// applyPipeline applies the steps in the spec's pipeline, in order,
+// to the resources given. Functions in the pipeline are checked
+// against the lock given, as for Eval, and their locks are recorded
+// in the lock for the spec, newLock.
+func applyPipeline(dir string, s spec.Spec, nodes []*yaml.RNode, lock, newLock *spec.Lock) ([]*yaml.RNode, *spec.Lock, error) {
+	if len(s.Pipeline) == 0 {
+		return nodes, newLock, nil
+	}
+	for i, step := range s.Pipeline {
+		var err error
+		switch names := step.Transformations(); {
+		case len(names) > 1:
+			err = fmt.Errorf("more than one transformation given (%s); use a step for each", strings.Join(names, ", "))
+		case step.Namespace != "":
+			err = setNamespace(nodes, step.Namespace)
+		case step.Labels != nil:
+			err = setMetadata(nodes, step.Labels, func(k, v string) yaml.Filter {
+				return yaml.SetLabel(k, v)
+			})
+		case step.Annotations != nil:
+			err = setMetadata(nodes, step.Annotations, func(k, v string) yaml.Filter {
+				return yaml.SetAnnotation(k, v)
+			})
+		case step.Images != nil:
+			err = overrideImages(nodes, step.Images)
+		case step.Patches != nil:
+			nodes, err = applyPatches(dir, nodes, step.Patches)
+		case step.JSONPatches != nil:
+			nodes, err = applyJSONPatches(dir, nodes, step.JSONPatches)
+		case step.Function != nil:
+			var fnLock *spec.Lock
+			nodes, fnLock, err = runPipelineFunction(dir, *step.Function, nodes, lock.PipelineLock(*step.Function))
+			if err == nil {
+				newLock.Pipeline = append(newLock.Pipeline, *fnLock)
+			}
+		default:
+			err = fmt.Errorf("no transformation given")
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("pipeline step %d: %w", i+1, err)
+		}
+	}
+	return nodes, newLock, nil
+}
+
+// runPipelineFunction runs the function given, with the resources
+// given as its input.
+func runPipelineFunction(dir string, fn spec.Spec, nodes []*yaml.RNode, lock *spec.Lock) ([]*yaml.RNode, *spec.Lock, error) {
+	switch fn.Kind {
+	case spec.ImageKind, spec.ExecKind, spec.StarlarkKind:
+	default:
+		return nil, nil, fmt.Errorf("a function in a pipeline must be of kind %s, %s or %s, not %q", spec.ImageKind, spec.ExecKind, spec.StarlarkKind, fn.Kind)
+	}
+	if len(fn.Pipeline) > 0 {
+		return nil, nil, fmt.Errorf("a function in a pipeline cannot have a pipeline of its own; put its steps in the pipeline after it")
+	}
+	if nodes == nil {
+		nodes = []*yaml.RNode{}
+	}
+	return evalSource(dir, fn, lock, nodes)
+}
+
+// isResource says whether the document given is a resource, i.e., has
+// an apiVersion and kind. Other documents are left alone by the
+// transformations that set metadata.
+func isResource(meta yaml.ResourceMeta) bool {
+	return meta.APIVersion != "" && meta.Kind != ""
+}
+
+// setNamespace sets the namespace of all the resources given, except
+// those known to be cluster-scoped.
+func setNamespace(nodes []*yaml.RNode, namespace string) error {
+	for _, node := range nodes {
+		meta, err := node.GetMeta()
+		if err == yaml.ErrMissingMetadata || (err == nil && !isResource(meta)) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if namespaced, known := openapi.IsNamespaceScoped(meta.TypeMeta); known && !namespaced {
+			continue
+		}
+		if err := node.PipeE(
+			yaml.LookupCreate(yaml.MappingNode, "metadata"),
+			yaml.SetField("namespace", yaml.NewScalarRNode(namespace))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setMetadata sets the labels or annotations given on all the
+// resources given, using the setter given.
+func setMetadata(nodes []*yaml.RNode, values map[string]string, setter func(k, v string) yaml.Filter) error {
+	for _, node := range nodes {
+		meta, err := node.GetMeta()
+		if err == yaml.ErrMissingMetadata || (err == nil && !isResource(meta)) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for k, v := range values {
+			if err := node.PipeE(setter(k, v)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// overrideImages changes the images used by containers (and init
+// containers) wherever they appear in the resources given.
+func overrideImages(nodes []*yaml.RNode, overrides []spec.ImageOverride) error {
+	var visit func(node *yaml.Node)
+	visit = func(node *yaml.Node) {
+		if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key, value := node.Content[i].Value, node.Content[i+1]
+				if (key == "containers" || key == "initContainers") && value.Kind == yaml.SequenceNode {
+					for _, container := range value.Content {
+						overrideContainerImage(container, overrides)
+					}
+				}
+			}
+		}
+		for _, child := range node.Content {
+			visit(child)
+		}
+	}
+	for _, node := range nodes {
+		visit(node.YNode())
+	}
+	return nil
+}
+
+func overrideContainerImage(container *yaml.Node, overrides []spec.ImageOverride) {
+	if container.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(container.Content); i += 2 {
+		if container.Content[i].Value != "image" {
+			continue
+		}
+		image := container.Content[i+1]
+		name, tag, digest := splitImage(image.Value)
+		for _, o := range overrides {
+			if o.Name != name {
+				continue
+			}
+			if o.NewName != "" {
+				name = o.NewName
+			}
+			switch {
+			case o.Digest != "":
+				tag, digest = "", o.Digest
+			case o.NewTag != "":
+				tag, digest = o.NewTag, ""
+			}
+			image.Value = joinImage(name, tag, digest)
+			break
+		}
+	}
+}
+
+// splitImage splits an image ref into its name, tag and digest, any
+// of which may be empty.
+func splitImage(ref string) (name, tag, digest string) {
+	name = ref
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, digest = name[:i], name[i+1:]
+	}
+	// a colon after the last slash is the tag; before it, it's the
+	// port of a registry
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, tag = name[:i], name[i+1:]
+	}
+	return name, tag, digest
+}
+
+func joinImage(name, tag, digest string) string {
+	if tag != "" {
+		name += ":" + tag
+	}
+	if digest != "" {
+		name += "@" + digest
+	}
+	return name
+}
+
+// findTarget gives the index of the resource with the kind and name
+// given, and namespace if given, or an error if there isn't exactly
+// one.
+func findTarget(nodes []*yaml.RNode, kind, name, namespace string) (int, error) {
+	found := -1
+	for i, node := range nodes {
+		meta, err := node.GetMeta()
+		if err != nil {
+			return -1, err
+		}
+		if meta.Kind != kind || meta.Name != name || (namespace != "" && meta.Namespace != namespace) {
+			continue
+		}
+		if found >= 0 {
+			return -1, fmt.Errorf("more than one %s named %s; give a namespace to choose one", kind, name)
+		}
+		found = i
+	}
+	if found < 0 {
+		return -1, fmt.Errorf("no %s named %s to patch", kind, name)
+	}
+	return found, nil
+}
+
+// applyPatches applies the strategic merge patches in the files given
+// to the resources given.
+func applyPatches(dir string, nodes []*yaml.RNode, files []string) ([]*yaml.RNode, error) {
+	for _, file := range files {
+		content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(file)))
+		if err != nil {
+			return nil, fmt.Errorf("could not read patch file: %w", err)
+		}
+		patches, err := (&kio.ByteReader{
+			Reader:                strings.NewReader(string(content)),
+			OmitReaderAnnotations: true,
+		}).Read()
+		if err != nil {
+			return nil, fmt.Errorf("could not parse patch file %s: %w", file, err)
+		}
+		for _, patch := range patches {
+			meta, err := patch.GetMeta()
+			if err != nil {
+				return nil, err
+			}
+			i, err := findTarget(nodes, meta.Kind, meta.Name, meta.Namespace)
+			if err != nil {
+				return nil, fmt.Errorf("patch in %s: %w", file, err)
+			}
+			patched, err := merge2.Merge(patch, nodes[i])
+			if err != nil {
+				return nil, fmt.Errorf("could not apply patch in %s: %w", file, err)
+			}
+			nodes[i] = patched
+		}
+	}
+	return nodes, nil
+}
+
+// applyJSONPatches applies the JSON patches given to the resources
+// given.
+func applyJSONPatches(dir string, nodes []*yaml.RNode, patches []spec.JSONPatch) ([]*yaml.RNode, error) {
+	for _, p := range patches {
+		content, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(p.Path)))
+		if err != nil {
+			return nil, fmt.Errorf("could not read patch file: %w", err)
+		}
+		// a patch in YAML is converted to JSON; JSON is left as is
+		patchJSON, err := k8syaml.YAMLToJSON(content)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse patch file %s: %w", p.Path, err)
+		}
+		patch, err := jsonpatch.DecodePatch(patchJSON)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse patch file %s: %w", p.Path, err)
+		}
+
+		i, err := findTarget(nodes, p.Target.Kind, p.Target.Name, p.Target.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("patch in %s: %w", p.Path, err)
+		}
+		doc, err := nodes[i].MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		patchedJSON, err := patch.Apply(doc)
+		if err != nil {
+			return nil, fmt.Errorf("could not apply patch in %s: %w", p.Path, err)
+		}
+		// going through JSON loses the order of fields, so put them
+		// back in the conventional order
+		node, err := yaml.ConvertJSONToYamlNode(string(patchedJSON))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := (filters.FormatFilter{}).Filter([]*yaml.RNode{node}); err != nil {
+			return nil, err
+		}
+		nodes[i] = node
+	}
+	return nodes, nil
+}
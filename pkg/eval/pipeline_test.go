@@ -0,0 +1,225 @@
+package eval
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+const pipelineResources = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: 1
+  template:
+    spec:
+      initContainers:
+      - name: init
+        image: busybox
+      containers:
+      - name: app
+        image: registry.example.com:5000/app:v1
+      - name: sidecar
+        image: envoy@sha256:abc
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: ClusterRole
+metadata:
+  name: app
+`
+
+func pipelineNodes(t *testing.T) []*yaml.RNode {
+	nodes, err := (&kio.ByteReader{Reader: strings.NewReader(pipelineResources), OmitReaderAnnotations: true}).Read()
+	assert.NoError(t, err)
+	return nodes
+}
+
+func lookup(t *testing.T, node *yaml.RNode, path ...string) string {
+	value, err := node.Pipe(yaml.Lookup(path...))
+	assert.NoError(t, err)
+	if value == nil {
+		return ""
+	}
+	return value.YNode().Value
+}
+
+func TestPipelineMetadata(t *testing.T) {
+	s := spec.Spec{Pipeline: []spec.Step{
+		{Namespace: "prod"},
+		{Labels: map[string]string{"team": "platform"}},
+		{Annotations: map[string]string{"owner": "someone"}},
+	}}
+	nodes, _, err := applyPipeline("", s, pipelineNodes(t), nil, &spec.Lock{})
+	assert.NoError(t, err)
+	assert.Equal(t, "prod", lookup(t, nodes[0], "metadata", "namespace"))
+	// cluster-scoped resources don't get a namespace
+	assert.Equal(t, "", lookup(t, nodes[1], "metadata", "namespace"))
+	for _, node := range nodes {
+		assert.Equal(t, "platform", lookup(t, node, "metadata", "labels", "team"))
+		assert.Equal(t, "someone", lookup(t, node, "metadata", "annotations", "owner"))
+	}
+
+	_, _, err = applyPipeline("", spec.Spec{Pipeline: []spec.Step{{}}}, pipelineNodes(t), nil, &spec.Lock{})
+	assert.Error(t, err)
+}
+
+func TestPipelineMetadataNonResource(t *testing.T) {
+	doc, err := yaml.Parse("settings:\n  a: b\n")
+	assert.NoError(t, err)
+	annotated, err := yaml.Parse("settings:\n  a: b\n")
+	assert.NoError(t, err)
+	// as given by Eval to the pipeline
+	assert.NoError(t, defaultFileAnnotations([]*yaml.RNode{annotated}))
+	nodes := append(pipelineNodes(t), doc, annotated)
+
+	s := spec.Spec{Pipeline: []spec.Step{
+		{Namespace: "prod"},
+		{Labels: map[string]string{"team": "platform"}},
+		{Annotations: map[string]string{"owner": "someone"}},
+	}}
+	nodes, _, err = applyPipeline("", s, nodes, nil, &spec.Lock{})
+	assert.NoError(t, err)
+	assert.Equal(t, "prod", lookup(t, nodes[0], "metadata", "namespace"))
+	assert.Equal(t, "settings:\n  a: b\n", nodes[2].MustString())
+	for _, node := range nodes[2:] {
+		assert.Equal(t, "", lookup(t, node, "metadata", "namespace"))
+		assert.Equal(t, "", lookup(t, node, "metadata", "labels", "team"))
+		assert.Equal(t, "", lookup(t, node, "metadata", "annotations", "owner"))
+	}
+}
+
+func TestPipelineImages(t *testing.T) {
+	s := spec.Spec{Pipeline: []spec.Step{
+		{Images: []spec.ImageOverride{
+			{Name: "busybox", NewTag: "1.32"},
+			{Name: "registry.example.com:5000/app", NewName: "mirror.example.com/app"},
+			{Name: "envoy", Digest: "sha256:def"},
+		}},
+	}}
+	nodes, _, err := applyPipeline("", s, pipelineNodes(t), nil, &spec.Lock{})
+	assert.NoError(t, err)
+	podSpec, err := nodes[0].Pipe(yaml.Lookup("spec", "template", "spec"))
+	assert.NoError(t, err)
+	init, err := podSpec.Pipe(yaml.Lookup("initContainers", "[name=init]"))
+	assert.NoError(t, err)
+	assert.Equal(t, "busybox:1.32", lookup(t, init, "image"))
+	app, err := podSpec.Pipe(yaml.Lookup("containers", "[name=app]"))
+	assert.NoError(t, err)
+	assert.Equal(t, "mirror.example.com/app:v1", lookup(t, app, "image"))
+	sidecar, err := podSpec.Pipe(yaml.Lookup("containers", "[name=sidecar]"))
+	assert.NoError(t, err)
+	assert.Equal(t, "envoy@sha256:def", lookup(t, sidecar, "image"))
+}
+
+func TestPipelinePatches(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"patches/replicas.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  replicas: 3
+`,
+		"patches/sidecar.json": `[{"op": "remove", "path": "/spec/template/spec/containers/1"}]`,
+		"patches/missing.yaml": `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: other
+`,
+	})
+
+	s := spec.Spec{Pipeline: []spec.Step{
+		{Patches: []string{"patches/replicas.yaml"}},
+		{JSONPatches: []spec.JSONPatch{{
+			Target: spec.Target{Kind: "Deployment", Name: "app"},
+			Path:   "patches/sidecar.json",
+		}}},
+	}}
+	nodes, _, err := applyPipeline(dir, s, pipelineNodes(t), nil, &spec.Lock{})
+	assert.NoError(t, err)
+	assert.Equal(t, "3", lookup(t, nodes[0], "spec", "replicas"))
+	containers, err := nodes[0].Pipe(yaml.Lookup("spec", "template", "spec", "containers"))
+	assert.NoError(t, err)
+	assert.Len(t, containers.YNode().Content, 1)
+	// the conventional field order is restored after a JSON patch
+	assert.Equal(t, "apiVersion", nodes[0].YNode().Content[0].Value)
+
+	s.Pipeline = []spec.Step{{Patches: []string{"patches/missing.yaml"}}}
+	_, _, err = applyPipeline(dir, s, pipelineNodes(t), nil, &spec.Lock{})
+	assert.Error(t, err)
+
+	assert.ElementsMatch(t, []string{"patches/missing.yaml"}, s.PipelineFiles())
+	nodes, err = ReadPackage(dir, s.PipelineFiles()...)
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1) // just the other patch
+}
+
+func TestPipelineFunction(t *testing.T) {
+	useRuntime(t, &fakeRuntime{images: map[string]fakeImage{
+		"example.com/labeller:v1": {
+			digest: "sha256:abc",
+			id:     "sha256:123",
+			run:    labeller,
+		},
+	}})
+
+	dir := writeFiles(t, map[string]string{
+		"gen.star": `ctx.resource_list["items"].append({"apiVersion": "v1", "kind": "ConfigMap", "metadata": {"name": "gen"}})`,
+	})
+	s := functionSpec(spec.StarlarkKind, "gen.star")
+	var fn spec.Spec
+	fn.Init(spec.ImageKind)
+	fn.Source = "example.com/labeller"
+	fn.Version = "v1"
+	s.Pipeline = []spec.Step{{Function: &fn}}
+
+	nodes, lock, err := Eval(dir, s, nil)
+	assert.NoError(t, err)
+	if assert.Len(t, nodes, 1) {
+		assert.Equal(t, "true", lookup(t, nodes[0], "metadata", "labels", "labelled"))
+	}
+	if assert.Len(t, lock.Pipeline, 1) {
+		assert.Equal(t, "sha256:abc", lock.Pipeline[0].Digest)
+	}
+
+	// functions in the pipeline are checked against the lock
+	lock.Pipeline[0].Digest = "sha256:def"
+	_, _, err = Eval(dir, s, lock)
+	assert.Error(t, err)
+
+	fn.Kind = spec.GitKind
+	_, _, err = Eval(dir, s, nil)
+	assert.Error(t, err)
+
+	// a function in a pipeline can't have a pipeline itself
+	fn.Kind = spec.ImageKind
+	fn.Pipeline = []spec.Step{{Namespace: "prod"}}
+	_, _, err = Eval(dir, s, nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "pipeline of its own")
+	}
+}
+
+func TestPipelineStepTransformations(t *testing.T) {
+	for _, step := range []spec.Step{
+		{},
+		{Namespace: "prod", Labels: map[string]string{"team": "platform"}},
+		{Images: []spec.ImageOverride{{Name: "busybox", NewTag: "1.32"}}, Function: &spec.Spec{}},
+	} {
+		s := spec.Spec{Pipeline: []spec.Step{step}}
+		_, _, err := applyPipeline("", s, pipelineNodes(t), nil, &spec.Lock{})
+		assert.Error(t, err, step.Transformations())
+	}
+
+	s := spec.Spec{Pipeline: []spec.Step{{Namespace: "prod", Labels: map[string]string{"team": "platform"}}}}
+	_, _, err := applyPipeline("", s, pipelineNodes(t), nil, &spec.Lock{})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "step 1: more than one transformation given (namespace, labels)")
+	}
+}
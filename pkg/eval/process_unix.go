@@ -0,0 +1,22 @@
+//go:build !windows
+// +build !windows
+
+package eval
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup makes the command given start in a process group
+// of its own, so that killProcessGroup can kill anything it starts
+// along with it.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills the process group of the command given,
+// which must have been started after setProcessGroup.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
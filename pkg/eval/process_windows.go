@@ -0,0 +1,14 @@
+package eval
+
+import (
+	"os/exec"
+)
+
+// There are no process groups to speak of on Windows, so only the
+// command itself is killed.
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,199 @@
+package eval
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// Log is where evaluation reports diagnostics that aren't errors,
+// e.g., warnings in the results from a function. It can be set to nil
+// to discard them.
+var Log io.Writer = os.Stderr
+
+// Severities of function results.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+	SeverityInfo    = "info"
+)
+
+// FunctionResult is a diagnostic reported by a function (e.g., an
+// image) in the results of the ResourceList it outputs.
+type FunctionResult struct {
+	Message  string
+	Severity string
+	// the resource the result is about, if any
+	ResourceRef ResourceRef
+	// the path of the field the result is about, if any
+	Field string
+	// the file the result is about, if any
+	File string
+}
+
+// ResourceRef identifies a resource.
+type ResourceRef struct {
+	APIVersion, Kind, Namespace, Name string
+}
+
+func (r ResourceRef) String() string {
+	name := r.Name
+	if r.Namespace != "" {
+		name = r.Namespace + "/" + name
+	}
+	return strings.TrimSpace(strings.Join([]string{r.APIVersion, r.Kind, name}, " "))
+}
+
+func (r FunctionResult) String() string {
+	severity := r.Severity
+	if severity == "" {
+		severity = SeverityInfo
+	}
+	var where []string
+	if ref := r.ResourceRef.String(); ref != "" {
+		where = append(where, ref)
+	}
+	if r.Field != "" {
+		where = append(where, "field "+r.Field)
+	}
+	if r.File != "" {
+		where = append(where, "file "+r.File)
+	}
+	if len(where) == 0 {
+		return fmt.Sprintf("%s: %s", severity, r.Message)
+	}
+	return fmt.Sprintf("%s: %s (%s)", severity, r.Message, strings.Join(where, ", "))
+}
+
+// FunctionError is returned when a function (e.g., an image) exits
+// with an error, or reports results with the severity "error".
+type FunctionError struct {
+	// describes the function, e.g., "image example.com/app:v1"
+	Function string
+	// the results with error severity
+	Results []FunctionResult
+	// what the function wrote to stderr
+	Stderr string
+	// the error from running the function, if it failed
+	Err error
+}
+
+func (e *FunctionError) Error() string {
+	var b strings.Builder
+	if e.Err != nil {
+		fmt.Fprintf(&b, "%s failed: %s", e.Function, e.Err)
+	} else {
+		fmt.Fprintf(&b, "%s reported errors", e.Function)
+	}
+	for _, r := range e.Results {
+		fmt.Fprintf(&b, "\n  %s", r)
+	}
+	if stderr := strings.TrimSpace(e.Stderr); stderr != "" {
+		fmt.Fprintf(&b, "\nstderr:\n%s", stderr)
+	}
+	return b.String()
+}
+
+func (e *FunctionError) Unwrap() error {
+	return e.Err
+}
+
+// rawResult is a result as it appears in a ResourceList. Results are
+// either a list of these (as in the KRM functions specification), or
+// a single object with the items in a list (as in older versions of
+// kyaml); and resourceRef is either flat, or has the name and
+// namespace under metadata.
+type rawResult struct {
+	Message     string `yaml:"message"`
+	Severity    string `yaml:"severity"`
+	ResourceRef struct {
+		APIVersion string `yaml:"apiVersion"`
+		Kind       string `yaml:"kind"`
+		Name       string `yaml:"name"`
+		Namespace  string `yaml:"namespace"`
+		Metadata   struct {
+			Name      string `yaml:"name"`
+			Namespace string `yaml:"namespace"`
+		} `yaml:"metadata"`
+	} `yaml:"resourceRef"`
+	Field struct {
+		Path string `yaml:"path"`
+	} `yaml:"field"`
+	File struct {
+		Path string `yaml:"path"`
+	} `yaml:"file"`
+	Items []rawResult `yaml:"items"`
+}
+
+// parseResults reads the results field of a ResourceList.
+func parseResults(node *yaml.RNode) ([]FunctionResult, error) {
+	if node == nil || node.YNode() == nil {
+		return nil, nil
+	}
+	var raw []rawResult
+	switch node.YNode().Kind {
+	case yaml.SequenceNode:
+		if err := node.YNode().Decode(&raw); err != nil {
+			return nil, fmt.Errorf("could not parse results: %w", err)
+		}
+	case yaml.MappingNode:
+		var r rawResult
+		if err := node.YNode().Decode(&r); err != nil {
+			return nil, fmt.Errorf("could not parse results: %w", err)
+		}
+		raw = []rawResult{r}
+	default:
+		return nil, nil
+	}
+
+	var results []FunctionResult
+	var add func([]rawResult)
+	add = func(raw []rawResult) {
+		for _, r := range raw {
+			if r.Items != nil {
+				add(r.Items)
+				continue
+			}
+			ref := ResourceRef{
+				APIVersion: r.ResourceRef.APIVersion,
+				Kind:       r.ResourceRef.Kind,
+				Name:       r.ResourceRef.Name,
+				Namespace:  r.ResourceRef.Namespace,
+			}
+			if ref.Name == "" {
+				ref.Name = r.ResourceRef.Metadata.Name
+			}
+			if ref.Namespace == "" {
+				ref.Namespace = r.ResourceRef.Metadata.Namespace
+			}
+			results = append(results, FunctionResult{
+				Message:     r.Message,
+				Severity:    r.Severity,
+				ResourceRef: ref,
+				Field:       r.Field.Path,
+				File:        r.File.Path,
+			})
+		}
+	}
+	add(raw)
+	return results, nil
+}
+
+// reportResults writes the results given to Log, and returns those
+// with error severity.
+func reportResults(name string, results []FunctionResult) []FunctionResult {
+	var errs []FunctionResult
+	for _, r := range results {
+		if r.Severity == SeverityError {
+			errs = append(errs, r)
+			continue
+		}
+		if Log != nil {
+			fmt.Fprintf(Log, "%s: %s\n", name, r)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,224 @@
+package eval
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// RuntimeEnv is the environment variable that names the container
+// runtime to use, when it's not given on the command line.
+const RuntimeEnv = "SPRESM_CONTAINER_RUNTIME"
+
+// Runtime is the container runtime used to evaluate images. If it's
+// nil, docker is used.
+var Runtime ContainerRuntime
+
+// ContainerRuntime is the interface to a container engine, as needed
+// to evaluate images.
+type ContainerRuntime interface {
+	// InspectImage gives the digest and ID of the image ref given,
+	// pulling the image if it's not present locally. The digest is
+	// the image's repository digest, or its ID if it has not been
+	// pushed to the repository given.
+	InspectImage(image, imageref string) (digest, id string, err error)
+	// Run runs the image with the ID given, with the options given,
+	// the input given on its stdin, and writes its stdout and stderr
+	// to the writers given. If the context is done before the
+	// container exits, the container is killed and the context's
+	// error is returned (possibly wrapped).
+	Run(ctx context.Context, id string, opts RunOptions, in io.Reader, out, errOut io.Writer) error
+}
+
+// RunOptions are the sandboxing and resource controls for running a
+// container. Empty fields are left to the container runtime.
+type RunOptions struct {
+	Network        string
+	ReadOnlyRootFS bool
+	User           string
+	CPUs, Memory   string
+}
+
+// RuntimeNames are the names of the container runtimes that can be
+// constructed with NewContainerRuntime.
+var RuntimeNames = []string{"docker", "podman", "nerdctl"}
+
+// NewContainerRuntime gives the container runtime with the name
+// given, which is one of RuntimeNames.
+func NewContainerRuntime(name string) (ContainerRuntime, error) {
+	for _, n := range RuntimeNames {
+		if n == name {
+			return &cliRuntime{command: name}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown container runtime %q; expected one of %s", name, strings.Join(RuntimeNames, ", "))
+}
+
+func containerRuntime() ContainerRuntime {
+	if Runtime == nil {
+		return &cliRuntime{command: "docker"}
+	}
+	return Runtime
+}
+
+// cliRuntime uses a container engine by running its command-line
+// tool. docker, podman and nerdctl all have the same arguments and
+// output for what's needed here.
+type cliRuntime struct {
+	command string
+}
+
+func (r *cliRuntime) InspectImage(image, imageref string) (string, string, error) {
+	inspect := func() ([]byte, error) {
+		return exec.Command(r.command, "image", "inspect", "--format", "{{json .}}", imageref).Output()
+	}
+	out, err := inspect()
+	if err != nil {
+		if err := exec.Command(r.command, "pull", "--quiet", imageref).Run(); err != nil {
+			return "", "", fmt.Errorf("could not pull image %s: %w", imageref, err)
+		}
+		if out, err = inspect(); err != nil {
+			return "", "", fmt.Errorf("could not inspect image %s: %w", imageref, err)
+		}
+	}
+
+	var info struct {
+		ID          string   `json:"Id"`
+		RepoDigests []string `json:"RepoDigests"`
+	}
+	if err := json.Unmarshal(out, &info); err != nil {
+		return "", "", fmt.Errorf("could not parse image details for %s: %w", imageref, err)
+	}
+	for _, repoDigest := range info.RepoDigests {
+		if strings.HasPrefix(repoDigest, image+"@") {
+			return repoDigest[len(image)+1:], info.ID, nil
+		}
+	}
+	return info.ID, info.ID, nil
+}
+
+func (r *cliRuntime) Run(ctx context.Context, id string, opts RunOptions, in io.Reader, out, errOut io.Writer) error {
+	// The container is named, so it can be killed if the context is
+	// done; killing the command-line tool won't necessarily stop the
+	// container.
+	name, err := containerName()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(r.command, runArgs(name, id, opts)...)
+	cmd.Stdin = in
+	cmd.Stdout = out // no streaming for now (could use `StdoutPipe`)
+	cmd.Stderr = errOut
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("running image %s with %s: %w", id, r.command, err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		if killErr := r.kill(name, cmd, done); killErr != nil {
+			return fmt.Errorf("running image %s with %s: %w", id, r.command, &stopError{cause: ctx.Err(), kill: killErr})
+		}
+		return fmt.Errorf("running image %s with %s: %w", id, r.command, ctx.Err())
+	}
+	if err != nil {
+		return fmt.Errorf("running image %s with %s: %w", id, r.command, err)
+	}
+	return nil
+}
+
+// killGracePeriod is how long to wait for a container, or the
+// command-line tool running it, to exit after it's been killed.
+var killGracePeriod = 10 * time.Second
+
+// kill stops the container with the name given, which is being run by
+// the command given; `done` gets the result of waiting for the
+// command. If the container can't be killed by name (e.g., because
+// it's still being created, or the engine isn't responding), or it
+// doesn't exit soon after, the command itself is killed, which may
+// leave the container running. Any error in killing the container is
+// returned.
+func (r *cliRuntime) kill(name string, cmd *exec.Cmd, done <-chan error) error {
+	// it may have exited just as the context was done
+	select {
+	case <-done:
+		return nil
+	default:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), killGracePeriod)
+	defer cancel()
+	var killErr error
+	if err := exec.CommandContext(ctx, r.command, "kill", name).Run(); err != nil {
+		killErr = fmt.Errorf("%s kill %s: %w", r.command, name, err)
+	} else {
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			killErr = fmt.Errorf("container %s did not exit within %s of being killed", name, killGracePeriod)
+		}
+	}
+
+	cmd.Process.Kill()
+	select {
+	case <-done:
+	case <-time.After(killGracePeriod):
+		// something started by the command is holding its output
+		// open; give up on it
+	}
+	return killErr
+}
+
+// stopError is returned from running a container which was to be
+// stopped, e.g., because of a timeout, but could not be killed.
+type stopError struct {
+	cause error // the reason for stopping it
+	kill  error // the error from killing it
+}
+
+func (e *stopError) Error() string {
+	return fmt.Sprintf("%v, and the container could not be killed: %v", e.cause, e.kill)
+}
+
+func (e *stopError) Unwrap() error {
+	return e.cause
+}
+
+// runArgs gives the arguments for running a container with the name,
+// image ID and options given.
+func runArgs(name, id string, opts RunOptions) []string {
+	args := []string{"run", "--rm", "-i", "--name", name}
+	if opts.Network != "" {
+		args = append(args, "--network", opts.Network)
+	}
+	if opts.ReadOnlyRootFS {
+		args = append(args, "--read-only", "--tmpfs", "/tmp")
+	}
+	if opts.User != "" {
+		args = append(args, "--user", opts.User)
+	}
+	if opts.CPUs != "" {
+		args = append(args, "--cpus", opts.CPUs)
+	}
+	if opts.Memory != "" {
+		args = append(args, "--memory", opts.Memory)
+	}
+	return append(args, id)
+}
+
+func containerName() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("could not generate container name: %w", err)
+	}
+	return "spresm-" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,56 @@
+package eval
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeCLI writes a script which stands in for a container runtime's
+// command-line tool: `run` runs until killed, and `kill` does what's
+// given.
+func fakeCLI(t *testing.T, kill string) *cliRuntime {
+	dir := writeFiles(t, map[string]string{
+		"cli": `#!/bin/sh
+dir=$(dirname $0)
+case "$1" in
+run) echo $$ > $dir/pid; exec sleep 30 ;;
+kill) ` + kill + ` ;;
+esac
+`,
+	})
+	assert.NoError(t, os.Chmod(filepath.Join(dir, "cli"), 0755))
+	return &cliRuntime{command: filepath.Join(dir, "cli")}
+}
+
+func TestCLIRuntimeTimeout(t *testing.T) {
+	previous := killGracePeriod
+	killGracePeriod = 200 * time.Millisecond
+	t.Cleanup(func() { killGracePeriod = previous })
+
+	for _, c := range []struct {
+		kill   string
+		killed bool
+	}{
+		{`kill $(cat $dir/pid)`, true},
+		{`echo "no such container" >&2; exit 1`, false},
+		{`exec sleep 30`, false}, // the engine isn't responding
+	} {
+		r := fakeCLI(t, c.kill)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		start := time.Now()
+		err := r.Run(ctx, "sha256:abc", RunOptions{}, strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+		cancel()
+		assert.Less(t, int64(time.Since(start)), int64(5*time.Second), c.kill)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded), c.kill)
+		var stopErr *stopError
+		assert.Equal(t, !c.killed, errors.As(err, &stopErr), c.kill)
+	}
+}
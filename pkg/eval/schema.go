@@ -0,0 +1,120 @@
+package eval
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+	"helm.sh/helm/v3/pkg/chart"
+	"helm.sh/helm/v3/pkg/chartutil"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+// ValuesError is returned when the values given for a chart don't
+// conform to the chart's schema (values.schema.json), or those of its
+// subcharts.
+type ValuesError struct {
+	Violations []Violation
+}
+
+// Violation is a single way in which values don't conform to a
+// schema.
+type Violation struct {
+	// the path to the offending value, e.g., "image.tag", or
+	// "(root)" for the values as a whole
+	Path    string
+	Message string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s", v.Path, v.Message)
+}
+
+func (e *ValuesError) Error() string {
+	lines := []string{"values do not conform to the chart's schema:"}
+	for _, v := range e.Violations {
+		lines = append(lines, "  - "+v.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ValidateValues checks the values given against the schema of the
+// chart, and the schemas of its subcharts, after coalescing them with
+// the chart's own values as Helm would. If there are any violations,
+// they are all returned in a *ValuesError.
+func ValidateValues(ch *chart.Chart, values map[string]interface{}) error {
+	coalesced, err := chartutil.CoalesceValues(ch, values)
+	if err != nil {
+		return fmt.Errorf("could not coalesce values: %w", err)
+	}
+	violations, err := validateChartValues(ch, coalesced, "")
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return &ValuesError{Violations: violations}
+	}
+	return nil
+}
+
+func validateChartValues(ch *chart.Chart, values map[string]interface{}, prefix string) ([]Violation, error) {
+	var violations []Violation
+	if ch.Schema != nil {
+		vs, err := validateAgainstSchema(values, ch.Schema)
+		if err != nil {
+			return nil, fmt.Errorf("could not validate values for chart %q: %w", ch.Name(), err)
+		}
+		for _, v := range vs {
+			if prefix != "" {
+				if v.Path == "(root)" {
+					v.Path = strings.TrimSuffix(prefix, ".")
+				} else {
+					v.Path = prefix + v.Path
+				}
+			}
+			violations = append(violations, v)
+		}
+	}
+	for _, sub := range ch.Dependencies() {
+		subValues, _ := values[sub.Name()].(map[string]interface{})
+		vs, err := validateChartValues(sub, subValues, prefix+sub.Name()+".")
+		if err != nil {
+			return nil, err
+		}
+		violations = append(violations, vs...)
+	}
+	return violations, nil
+}
+
+func validateAgainstSchema(values map[string]interface{}, schema []byte) ([]Violation, error) {
+	if values == nil {
+		values = map[string]interface{}{}
+	}
+	valuesJSON, err := k8syaml.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	if valuesJSON, err = k8syaml.YAMLToJSON(valuesJSON); err != nil {
+		return nil, err
+	}
+	result, err := gojsonschema.Validate(gojsonschema.NewBytesLoader(schema), gojsonschema.NewBytesLoader(valuesJSON))
+	if err != nil {
+		return nil, err
+	}
+	var violations []Violation
+	for _, e := range result.Errors() {
+		violations = append(violations, Violation{
+			Path:    e.Field(),
+			Message: e.Description(),
+		})
+	}
+	// the order isn't stable otherwise
+	sort.Slice(violations, func(i, j int) bool {
+		if violations[i].Path != violations[j].Path {
+			return violations[i].Path < violations[j].Path
+		}
+		return violations[i].Message < violations[j].Message
+	})
+	return violations, nil
+}
@@ -0,0 +1,65 @@
+package eval
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/squaremo/spresm/pkg/spec"
+)
+
+func makeChartWithSchema(t *testing.T) string {
+	return writeFiles(t, map[string]string{
+		"app/Chart.yaml": `apiVersion: v2
+name: app
+version: 0.1.0
+`,
+		"app/values.yaml": "replicas: 1\n",
+		"app/values.schema.json": `{
+  "type": "object",
+  "required": ["replicas"],
+  "properties": {
+    "replicas": {"type": "integer"},
+    "image": {
+      "type": "object",
+      "properties": {"tag": {"type": "string"}},
+      "additionalProperties": false
+    }
+  }
+}`,
+		"app/templates/cm.yaml":     "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n",
+		"app/charts/sub/Chart.yaml": "apiVersion: v2\nname: sub\nversion: 0.1.0\n",
+		"app/charts/sub/values.schema.json": `{
+  "type": "object",
+  "properties": {"port": {"type": "integer", "minimum": 1}}
+}`,
+	}) + "/app"
+}
+
+func TestValidateValues(t *testing.T) {
+	var s spec.Spec
+	s.Init(spec.ChartKind)
+	s.Source = makeChartWithSchema(t)
+
+	_, _, err := Eval("", s, nil)
+	assert.NoError(t, err)
+
+	s.Helm.Values = map[string]interface{}{
+		"replicas": "two",
+		"image":    map[string]interface{}{"tga": "v1"},
+		"sub":      map[string]interface{}{"port": 0},
+	}
+	_, _, err = Eval("", s, nil)
+	var valuesErr *ValuesError
+	if assert.IsType(t, valuesErr, err) {
+		valuesErr = err.(*ValuesError)
+		var paths []string
+		for _, v := range valuesErr.Violations {
+			paths = append(paths, v.Path)
+		}
+		assert.ElementsMatch(t, []string{"replicas", "image", "sub.port"}, paths)
+	}
+
+	// CheckValues gives the same result without rendering
+	assert.Equal(t, err, CheckValues("", s, nil))
+}
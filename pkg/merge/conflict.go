@@ -0,0 +1,72 @@
+package merge
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// ConflictClass says what kind of conflict was encountered when
+// merging a resource.
+type ConflictClass string
+
+const (
+	// the resource was changed upstream, but removed locally
+	ConflictRemovedLocally ConflictClass = "RemovedLocally"
+	// the resource was changed locally, but removed upstream
+	ConflictRemovedUpstream ConflictClass = "RemovedUpstream"
+	// the resource was added both locally and upstream
+	ConflictAddedInBoth ConflictClass = "AddedInBoth"
+)
+
+var conflictDescriptions = map[ConflictClass]string{
+	ConflictRemovedLocally:  "changed upstream, but removed locally",
+	ConflictRemovedUpstream: "changed locally, but removed upstream",
+	ConflictAddedInBoth:     "added upstream, and added locally",
+}
+
+// Conflict records a resource that could not be merged. Any of the
+// versions of the resource may be nil, if it is not present in that
+// set of resources.
+type Conflict struct {
+	Identifier yaml.ResourceIdentifier
+	// for documents that aren't resources, and so have no
+	// identifier, the file and position they were read from.
+	Path, Index string
+	Class       ConflictClass
+	Mine        *yaml.RNode
+	Orig        *yaml.RNode
+	Yours       *yaml.RNode
+}
+
+// String gives a readable description of the conflict.
+func (c Conflict) String() string {
+	desc, ok := conflictDescriptions[c.Class]
+	if !ok {
+		desc = string(c.Class)
+	}
+	return fmt.Sprintf("%s: %s", describe(c.Identifier, c.Path, c.Index), desc)
+}
+
+// describe gives a readable name to a document, either by its
+// resource identifier, or where it was read from if it doesn't have
+// one.
+func describe(id yaml.ResourceIdentifier, path, index string) string {
+	if id != (yaml.ResourceIdentifier{}) {
+		return FormatIdentifier(id)
+	}
+	if index == "" {
+		index = "0"
+	}
+	return fmt.Sprintf("document %s in %q", index, path)
+}
+
+// FormatIdentifier renders a resource identifier in a readable way,
+// e.g., "apps/v1 Deployment app/bar".
+func FormatIdentifier(id yaml.ResourceIdentifier) string {
+	name := id.Name
+	if id.Namespace != "" {
+		name = id.Namespace + "/" + name
+	}
+	return fmt.Sprintf("%s %s %s", id.APIVersion, id.Kind, name)
+}
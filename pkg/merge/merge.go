@@ -2,28 +2,41 @@ package merge
 
 import (
 	"fmt"
+	"reflect"
+	"strings"
 
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 	"sigs.k8s.io/kustomize/kyaml/yaml/merge3"
 )
 
 // Merge takes three sets of resources -- mine (aka dest), orig (aka
 // base, aka older), and yours (aka updated) -- and does a three-way
-// merge. It returns an error if the merge has conflicts.
+// merge. It returns the merged resources, and a list of the conflicts
+// encountered; or, an error if the merge could not be done at all.
+//
+// A resource that is in conflict is left as it is in `mine` (or left
+// out, if it's not in `mine`), so that the merged result can be
+// written out and the conflicts resolved by hand.
 //
 // See
 // https://www.gnu.org/software/diffutils/manual/html_node/diff3-Merging.html
 // for more information about three-way merge.
-//
-// TODO don't fail utterly when there's conflicts; report the
-// conflicts instead, or add conflict markers somehow.
-func Merge(mineNodes, origNodes, yoursNodes []*yaml.RNode) ([]*yaml.RNode, error) {
-	orig := nodesToMap(origNodes)
-	yours := nodesToMap(yoursNodes)
+func Merge(mineNodes, origNodes, yoursNodes []*yaml.RNode) ([]*yaml.RNode, []Conflict, error) {
+	_, mineDups := nodesToMap(mineNodes)
+	orig, origDups := nodesToMap(origNodes)
+	yours, yoursDups := nodesToMap(yoursNodes)
+	if dups := append(append(sideDuplicates("mine", mineDups),
+		sideDuplicates("orig", origDups)...),
+		sideDuplicates("yours", yoursDups)...); len(dups) > 0 {
+		return nil, nil, &DuplicatesError{Duplicates: dups}
+	}
 
 	// Resource set merge algorithm:
 	//
-	// For each resource (as identified by GVK+namespace/name)
+	// For each resource (as identified by GVK+namespace/name; or for
+	// documents that aren't resources, by the file and position in
+	// the file it came from)
 	//
 	// - if present in all, then do three-way merge
 
@@ -44,6 +57,7 @@ func Merge(mineNodes, origNodes, yoursNodes []*yaml.RNode) ([]*yaml.RNode, error
 	// ("removed upstream but changed locally"), otherwise lose it.
 
 	result := []*yaml.RNode{}
+	var conflicts []Conflict
 
 	// The following bears a resemblance to
 	// https://github.com/kubernetes-sigs/kustomize/blob/master/kyaml/kio/filters/merge3.go#L79,
@@ -53,52 +67,72 @@ func Merge(mineNodes, origNodes, yoursNodes []*yaml.RNode) ([]*yaml.RNode, error
 	// - it treats change/remove conflicts as conflicts
 
 	for _, mineNode := range mineNodes {
-		meta, err := mineNode.GetMeta()
-		if err != nil {
-			continue // FIXME think about this; ignores anything without meta
-		}
-		mineId := meta.GetIdentifier()
-		origNode, origOk := orig[mineId]
-		yoursNode, yoursOk := yours[mineId]
+		mineKey := keyOf(mineNode)
+		origNode, origOk := orig[mineKey]
+		yoursNode, yoursOk := yours[mineKey]
 		switch {
 		case origOk && yoursOk:
 			// present in all three
 
 			// remove from consideration later
-			delete(orig, mineId)
-			delete(yours, mineId)
+			delete(orig, mineKey)
+			delete(yours, mineKey)
 			merged, err := merge3.Merge(mineNode, origNode, yoursNode)
 			if err != nil {
-				return nil, err
+				return nil, nil, err
 			}
 			result = append(result, merged)
 			break
-		case origOk: // and not theirsOk
-			// removed in local directory
+		case origOk: // and not yoursOk
+			// removed upstream
 
 			// remove from consideration later
-			delete(orig, mineId)
-			// TODO actually check if they differ; this needs either a
-			// walk or a serialisation
-			return nil, fmt.Errorf("resource %v is changed from original, but removed in local files", mineId)
+			delete(orig, mineKey)
+			same, err := equal(mineNode, origNode)
+			if err != nil {
+				return nil, nil, err
+			}
+			if same {
+				// unchanged locally, so lose it
+				break
+			}
+			conflicts = append(conflicts, mineKey.conflict(ConflictRemovedUpstream, mineNode, origNode, nil))
+			result = append(result, mineNode)
 		case yoursOk: // and not baseOk
 			// added locally and new in generated files -- conflict.
-			return nil, fmt.Errorf("resource %v from generated resources conflicts with resource added locally", mineId)
+
+			// remove from consideration later
+			delete(yours, mineKey)
+			conflicts = append(conflicts, mineKey.conflict(ConflictAddedInBoth, mineNode, nil, yoursNode))
+			result = append(result, mineNode)
 		default: // only in ours
 			result = append(result, mineNode)
 		}
 	}
 
 	// that's all the resources from ours. Now to compare any that are
-	// in either or both of base and theirs.
-	for origId, _ := range orig {
-		_, yoursOk := yours[origId]
+	// in either or both of base and theirs. These are looked at in
+	// the order given, so the result is predictable.
+	for _, origNode := range origNodes {
+		origKey := keyOf(origNode)
+		if _, ok := orig[origKey]; !ok {
+			continue // already dealt with
+		}
+		delete(orig, origKey)
+		yoursNode, yoursOk := yours[origKey]
 		switch {
 		case yoursOk:
 			// in base and theirs, not in ours.
-			delete(yours, origId) // remove from consideration later
-			// TODO actually check if it's different.
-			return nil, fmt.Errorf("resource %v changed from original, but removed in generated files", origId)
+			delete(yours, origKey) // remove from consideration later
+			same, err := equal(origNode, yoursNode)
+			if err != nil {
+				return nil, nil, err
+			}
+			if same {
+				// unchanged upstream, so lose it
+				break
+			}
+			conflicts = append(conflicts, origKey.conflict(ConflictRemovedLocally, nil, origNode, yoursNode))
 		default:
 			// only in base; lose it.
 			break
@@ -106,23 +140,133 @@ func Merge(mineNodes, origNodes, yoursNodes []*yaml.RNode) ([]*yaml.RNode, error
 	}
 
 	// lastly, anything left in theirs is not generated, so keep it.
-	for _, yoursNode := range yours {
-		result = append(result, yoursNode)
+	for _, yoursNode := range yoursNodes {
+		if _, ok := yours[keyOf(yoursNode)]; ok {
+			result = append(result, yoursNode)
+		}
 	}
 
-	return result, nil
+	return result, conflicts, nil
+}
+
+// equal reports whether two resources are the same, ignoring
+// formatting, comments, the order of fields, and the annotations
+// recording which file they were read from.
+func equal(a, b *yaml.RNode) (bool, error) {
+	av, err := normalise(a)
+	if err != nil {
+		return false, err
+	}
+	bv, err := normalise(b)
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(av, bv), nil
 }
 
-func nodesToMap(nodes []*yaml.RNode) map[yaml.ResourceIdentifier]*yaml.RNode {
-	mapped := make(map[yaml.ResourceIdentifier]*yaml.RNode)
-	// FIXME deal with duplicates
+func normalise(node *yaml.RNode) (interface{}, error) {
+	var value interface{}
+	if err := node.YNode().Decode(&value); err != nil {
+		return nil, err
+	}
+	obj, ok := value.(map[string]interface{})
+	if !ok {
+		return value, nil
+	}
+	if meta, ok := obj["metadata"].(map[string]interface{}); ok {
+		if annotations, ok := meta["annotations"].(map[string]interface{}); ok {
+			delete(annotations, kioutil.PathAnnotation)
+			delete(annotations, kioutil.IndexAnnotation)
+			if len(annotations) == 0 {
+				delete(meta, "annotations")
+			}
+		}
+	}
+	return obj, nil
+}
+
+// nodeKey is used to match documents in the different sets being
+// merged. Resources are matched by their identifier; anything else
+// (documents without a name, or that aren't objects at all, and
+// Lists) by the file and position it was read from.
+type nodeKey struct {
+	id    yaml.ResourceIdentifier
+	path  string
+	index string
+}
+
+func keyOf(node *yaml.RNode) nodeKey {
+	meta, err := node.GetMeta()
+	if err == nil && meta.Name != "" && meta.Kind != "" && meta.Kind != "List" {
+		return nodeKey{id: meta.GetIdentifier()}
+	}
+	// the annotations can be got at even if the meta can't be, so
+	// long as it's a map
+	path, index, _ := kioutil.GetFileAnnotations(node)
+	return nodeKey{path: path, index: index}
+}
+
+func (k nodeKey) conflict(class ConflictClass, mine, orig, yours *yaml.RNode) Conflict {
+	return Conflict{
+		Identifier: k.id,
+		Path:       k.path,
+		Index:      k.index,
+		Class:      class,
+		Mine:       mine,
+		Orig:       orig,
+		Yours:      yours,
+	}
+}
+
+// nodesToMap indexes the nodes given by their key, returning the
+// index, and the keys (if any) that appeared more than once.
+func nodesToMap(nodes []*yaml.RNode) (map[nodeKey]*yaml.RNode, []nodeKey) {
+	mapped := make(map[nodeKey]*yaml.RNode)
+	var dups []nodeKey
 	for _, node := range nodes {
-		meta, err := node.GetMeta()
-		// FIXME think about this: it'll exclude anything it couldn't
-		// treat as a resource.
-		if err == nil {
-			mapped[meta.GetIdentifier()] = node
+		key := keyOf(node)
+		if _, ok := mapped[key]; ok {
+			dups = append(dups, key)
+			continue
 		}
+		mapped[key] = node
+	}
+	return mapped, dups
+}
+
+// Duplicate records a resource that appears more than once in one of
+// the sets given to Merge.
+type Duplicate struct {
+	// which set of resources: "mine", "orig" or "yours"
+	Side       string
+	Identifier yaml.ResourceIdentifier
+	// for documents that aren't resources, where it was read from
+	Path, Index string
+}
+
+func (d Duplicate) String() string {
+	return fmt.Sprintf("%s (in %s)", describe(d.Identifier, d.Path, d.Index), d.Side)
+}
+
+// DuplicatesError is returned by Merge when resources cannot be
+// matched up, because an identifier appears more than once in one or
+// more of the sets of resources.
+type DuplicatesError struct {
+	Duplicates []Duplicate
+}
+
+func (e *DuplicatesError) Error() string {
+	var descs []string
+	for _, d := range e.Duplicates {
+		descs = append(descs, d.String())
+	}
+	return "duplicate resources cannot be merged: " + strings.Join(descs, "; ")
+}
+
+func sideDuplicates(side string, keys []nodeKey) []Duplicate {
+	var dups []Duplicate
+	for _, k := range keys {
+		dups = append(dups, Duplicate{Side: side, Identifier: k.id, Path: k.path, Index: k.index})
 	}
-	return mapped
+	return dups
 }
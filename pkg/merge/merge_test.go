@@ -7,24 +7,23 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/kioutil"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
 
-func testMerge(t *testing.T, oursSrc, baseSrc, theirsSrc, expected string) {
-	var ours, base, theirs []*yaml.RNode
+func parse(t *testing.T, src string) []*yaml.RNode {
+	reader := kio.ByteReader{Reader: bytes.NewBuffer([]byte(src))}
+	nodes, err := reader.Read()
+	assert.NoError(t, err)
+	return nodes
+}
 
-	parse := func(src string, slice *[]*yaml.RNode) {
-		reader := kio.ByteReader{Reader: bytes.NewBuffer([]byte(src))}
-		nodes, err := reader.Read()
-		assert.NoError(t, err)
-		*slice = nodes
-	}
-	parse(oursSrc, &ours)
-	parse(baseSrc, &base)
-	parse(theirsSrc, &theirs)
+func testMerge(t *testing.T, oursSrc, baseSrc, theirsSrc, expected string) {
+	ours, base, theirs := parse(t, oursSrc), parse(t, baseSrc), parse(t, theirsSrc)
 
-	merged, err := Merge(ours, base, theirs)
+	merged, conflicts, err := Merge(ours, base, theirs)
 	assert.NoError(t, err)
+	assert.Empty(t, conflicts)
 
 	buf := &bytes.Buffer{}
 	writer := kio.ByteWriter{Writer: buf}
@@ -322,3 +321,350 @@ spec:
 `
 	testMerge(t, updated, base, local, updated)
 }
+
+func testMergeConflict(t *testing.T, oursSrc, baseSrc, theirsSrc string, expected ...ConflictClass) []Conflict {
+	ours, base, theirs := parse(t, oursSrc), parse(t, baseSrc), parse(t, theirsSrc)
+
+	_, conflicts, err := Merge(ours, base, theirs)
+	assert.NoError(t, err)
+	var classes []ConflictClass
+	for _, c := range conflicts {
+		classes = append(classes, c.Class)
+	}
+	assert.ElementsMatch(t, expected, classes)
+	return conflicts
+}
+
+// A resource added upstream and locally is a conflict; but the other
+// resources are still merged.
+func TestConflictAddedInBoth(t *testing.T) {
+	base := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+`
+	local := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+data:
+  local: "true"
+`
+	updated := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+spec:
+  type: NodePort
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+data:
+  upstream: "true"
+`
+	conflicts := testMergeConflict(t, local, base, updated, ConflictAddedInBoth)
+	c := conflicts[0]
+	assert.Equal(t, "bar", c.Identifier.Name)
+	assert.NotNil(t, c.Mine)
+	assert.Nil(t, c.Orig)
+	assert.NotNil(t, c.Yours)
+	assert.Equal(t, "v1 ConfigMap bar: added upstream, and added locally", c.String())
+
+	merged, _, err := Merge(parse(t, local), parse(t, base), parse(t, updated))
+	assert.NoError(t, err)
+	buf := &bytes.Buffer{}
+	assert.NoError(t, kio.ByteWriter{Writer: buf}.Write(merged))
+	assert.Equal(t, strings.TrimSpace(`
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+spec:
+  type: NodePort
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: bar
+data:
+  local: "true"
+`), strings.TrimSpace(buf.String()))
+}
+
+// All conflicts are reported, not just the first.
+func TestConflictsAllReported(t *testing.T) {
+	base := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: removed-locally
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: removed-upstream
+`
+	local := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: removed-upstream
+spec:
+  type: NodePort
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: added
+`
+	updated := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: removed-locally
+spec:
+  type: NodePort
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: added
+spec:
+  type: NodePort
+`
+	testMergeConflict(t, local, base, updated,
+		ConflictRemovedLocally, ConflictRemovedUpstream, ConflictAddedInBoth)
+}
+
+// A resource removed locally, and not changed upstream, stays removed.
+func TestRemovedLocallyUnchangedUpstream(t *testing.T) {
+	base := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: bar
+spec:
+  ports: [{port: 80}]
+`
+	local := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+`
+	// same thing, with the fields in a different order and
+	// formatted differently
+	updated := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+---
+spec:
+  ports:
+  - port: 80
+kind: Service
+apiVersion: v1
+metadata: {name: bar}  # comment
+`
+	testMerge(t, local, base, updated, local)
+}
+
+// A resource removed upstream, and not changed locally, is removed.
+func TestRemovedUpstreamUnchangedLocally(t *testing.T) {
+	base := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: bar
+`
+	// this looks like it was read from files, and has the
+	// annotations to show for it
+	local := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+  annotations:
+    config.kubernetes.io/path: foo.yaml
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: bar
+  annotations:
+    config.kubernetes.io/path: bar.yaml
+    config.kubernetes.io/index: '0'
+`
+	updated := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+`
+	testMerge(t, local, base, updated, `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+  annotations:
+    config.kubernetes.io/path: foo.yaml
+`)
+}
+
+// A resource removed upstream, but with other annotations changed
+// locally, is a conflict.
+func TestRemovedUpstreamAnnotatedLocally(t *testing.T) {
+	base := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: bar
+`
+	local := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: bar
+  annotations:
+    config.kubernetes.io/path: bar.yaml
+    example.com/owner: me
+`
+	testMergeConflict(t, local, base, "# nothing", ConflictRemovedUpstream)
+}
+
+// Duplicate resources on any side are reported, all at once.
+func TestDuplicates(t *testing.T) {
+	dup := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+`
+	single := `
+apiVersion: v1
+kind: Service
+metadata:
+  name: foo
+`
+	_, _, err := Merge(parse(t, dup), parse(t, single), parse(t, dup))
+	assert.Error(t, err)
+	dupErr, ok := err.(*DuplicatesError)
+	if assert.True(t, ok) {
+		var sides []string
+		for _, d := range dupErr.Duplicates {
+			assert.Equal(t, "foo", d.Identifier.Name)
+			sides = append(sides, d.Side)
+		}
+		assert.Equal(t, []string{"mine", "yours"}, sides)
+	}
+}
+
+// Documents that aren't resources are merged according to where they
+// came from.
+func TestNonResources(t *testing.T) {
+	parseFile := func(path, src string) []*yaml.RNode {
+		reader := kio.ByteReader{
+			Reader:         bytes.NewBufferString(src),
+			SetAnnotations: map[string]string{kioutil.PathAnnotation: path},
+		}
+		nodes, err := reader.Read()
+		assert.NoError(t, err)
+		return nodes
+	}
+
+	base := `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: foo
+---
+settings:
+  colour: blue
+  size: large
+`
+	local := `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: foo
+---
+settings:
+  colour: red
+  size: large
+`
+	updated := `
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: foo
+---
+settings:
+  colour: blue
+  size: small
+`
+	merged, conflicts, err := Merge(
+		parseFile("things.yaml", local),
+		parseFile("things.yaml", base),
+		append(parseFile("things.yaml", updated), parseFile("other.yaml", "just: data\n")...))
+	assert.NoError(t, err)
+	assert.Empty(t, conflicts)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, kio.ByteWriter{Writer: buf, ClearAnnotations: []string{kioutil.PathAnnotation}}.Write(merged))
+	assert.Equal(t, strings.TrimSpace(`
+apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Service
+  metadata:
+    name: foo
+---
+settings:
+  colour: red
+  size: small
+---
+just: data
+`), strings.TrimSpace(buf.String()))
+}
+
+// Documents that aren't resources can conflict too.
+func TestNonResourceConflict(t *testing.T) {
+	conflicts := testMergeConflict(t, "# removed", "colour: blue\n", "colour: red\n", ConflictRemovedLocally)
+	assert.Equal(t, `document 0 in "": changed upstream, but removed locally`, conflicts[0].String())
+}
@@ -0,0 +1,314 @@
+package merge
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValueChangeClass says what happened to a value when merging values.
+type ValueChangeClass string
+
+const (
+	// the value was not overridden, and has been removed upstream;
+	// it's dropped
+	ValueRemoved ValueChangeClass = "Removed"
+	// the value was overridden, and has been removed upstream; the
+	// override is kept
+	ValueConflictRemovedUpstream ValueChangeClass = "RemovedUpstream"
+	// the value was overridden, and the default has changed
+	// upstream; the override is kept
+	ValueConflictChangedInBoth ValueChangeClass = "ChangedInBoth"
+	// the value was removed locally, and the default has changed
+	// upstream; it stays removed
+	ValueConflictRemovedLocally ValueChangeClass = "RemovedLocally"
+)
+
+var valueChangeDescriptions = map[ValueChangeClass]string{
+	ValueRemoved:                 "removed upstream",
+	ValueConflictRemovedUpstream: "removed upstream, but overridden locally; keeping the local value",
+	ValueConflictChangedInBoth:   "default changed upstream, but overridden locally; keeping the local value",
+	ValueConflictRemovedLocally:  "default changed upstream, but removed locally; keeping it removed",
+}
+
+// ValueChange records something that needs attention after merging
+// values: a value that was removed, or a conflict.
+type ValueChange struct {
+	// the path to the value, e.g., "image.tag"
+	Path  string
+	Class ValueChangeClass
+	// the values on each side; any may be nil if absent
+	Mine, Orig, Yours interface{}
+}
+
+// IsConflict says whether the change is a conflict, as opposed to
+// something merely to report.
+func (c ValueChange) IsConflict() bool {
+	return c.Class != ValueRemoved
+}
+
+func (c ValueChange) String() string {
+	desc, ok := valueChangeDescriptions[c.Class]
+	if !ok {
+		desc = string(c.Class)
+	}
+	switch c.Class {
+	case ValueConflictChangedInBoth:
+		return fmt.Sprintf("%s: %s (was %s, now %s, local %s)", c.Path, desc, show(c.Orig), show(c.Yours), show(c.Mine))
+	case ValueConflictRemovedLocally:
+		return fmt.Sprintf("%s: %s (was %s, now %s)", c.Path, desc, show(c.Orig), show(c.Yours))
+	default:
+		return fmt.Sprintf("%s: %s", c.Path, desc)
+	}
+}
+
+func show(v interface{}) string {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(bs)
+}
+
+// MergeValues does a three-way merge of values (e.g., for a Helm
+// chart): `mine` are the values in use, `orig` are the defaults they
+// were based on, and `yours` are the new defaults. Values that weren't
+// changed from the original defaults take the new defaults; values
+// that were changed are kept. The changes that need reporting are
+// returned, sorted by path.
+func MergeValues(mine, orig, yours map[string]interface{}) (map[string]interface{}, []ValueChange) {
+	var changes []ValueChange
+	merged := mergeMaps("", mine, orig, yours, &changes)
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return merged, changes
+}
+
+func mergeMaps(prefix string, mine, orig, yours map[string]interface{}, changes *[]ValueChange) map[string]interface{} {
+	keys := map[string]struct{}{}
+	for _, m := range []map[string]interface{}{mine, orig, yours} {
+		for k := range m {
+			keys[k] = struct{}{}
+		}
+	}
+
+	result := map[string]interface{}{}
+	for k := range keys {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		m, inMine := mine[k]
+		o, inOrig := orig[k]
+		y, inYours := yours[k]
+
+		switch {
+		case sameValue(m, inMine, o, inOrig):
+			// untouched locally, so take whatever is upstream now
+			if inYours {
+				result[k] = y
+			} else if inOrig {
+				*changes = append(*changes, ValueChange{Path: path, Class: ValueRemoved, Orig: o})
+			}
+		case sameValue(y, inYours, o, inOrig):
+			// untouched upstream, so keep the local value
+			if inMine {
+				result[k] = m
+			}
+		case sameValue(m, inMine, y, inYours):
+			// the same change both sides
+			result[k] = m
+		default:
+			mm, mineIsMap := m.(map[string]interface{})
+			ym, yoursIsMap := y.(map[string]interface{})
+			if mineIsMap && yoursIsMap {
+				om, _ := o.(map[string]interface{})
+				result[k] = mergeMaps(path, mm, om, ym, changes)
+				continue
+			}
+			if !inMine {
+				// removed locally, and changed upstream; respect the
+				// removal, since it can't be told from an override
+				*changes = append(*changes, ValueChange{Path: path, Class: ValueConflictRemovedLocally, Orig: o, Yours: y})
+				continue
+			}
+			class := ValueConflictChangedInBoth
+			if !inYours {
+				class = ValueConflictRemovedUpstream
+			}
+			*changes = append(*changes, ValueChange{Path: path, Class: class, Mine: m, Orig: o, Yours: y})
+			result[k] = m
+		}
+	}
+	return result
+}
+
+// sameValue compares values, regardless of representation (e.g.,
+// whether a number was decoded as an int or a float).
+func sameValue(a interface{}, aPresent bool, b interface{}, bPresent bool) bool {
+	if aPresent != bPresent {
+		return false
+	}
+	if !aPresent {
+		return true
+	}
+	return reflect.DeepEqual(normaliseValue(a), normaliseValue(b))
+}
+
+func normaliseValue(v interface{}) interface{} {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var out interface{}
+	if err := json.Unmarshal(bs, &out); err != nil {
+		return v
+	}
+	return out
+}
+
+// Overrides gives the values that differ from the defaults given,
+// i.e., the least that needs to be supplied along with the defaults
+// to get the values given. A default that is absent from the values
+// is overridden with null, which removes it.
+func Overrides(values, defaults map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for k, v := range values {
+		d, ok := defaults[k]
+		if !ok {
+			result[k] = v
+			continue
+		}
+		vm, valueIsMap := v.(map[string]interface{})
+		dm, defaultIsMap := d.(map[string]interface{})
+		if valueIsMap && defaultIsMap {
+			if sub := Overrides(vm, dm); len(sub) > 0 {
+				result[k] = sub
+			}
+			continue
+		}
+		if !sameValue(v, true, d, true) {
+			result[k] = v
+		}
+	}
+	for k, d := range defaults {
+		if _, ok := values[k]; !ok && d != nil {
+			result[k] = nil
+		}
+	}
+	return result
+}
+
+// ApplyOverrides gives the defaults with the overrides given applied,
+// as Helm would do it: maps are merged, other values are replaced, and
+// a null removes the value. Neither argument is modified.
+func ApplyOverrides(defaults, overrides map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	for k, d := range defaults {
+		if dm, ok := d.(map[string]interface{}); ok {
+			d = ApplyOverrides(dm, nil)
+		}
+		result[k] = d
+	}
+	for k, o := range overrides {
+		if o == nil {
+			delete(result, k)
+			continue
+		}
+		om, overrideIsMap := o.(map[string]interface{})
+		dm, defaultIsMap := result[k].(map[string]interface{})
+		if overrideIsMap && defaultIsMap {
+			result[k] = ApplyOverrides(dm, om)
+			continue
+		}
+		if overrideIsMap {
+			o = ApplyOverrides(nil, om)
+		}
+		result[k] = o
+	}
+	return result
+}
+
+// ApplyOverridesToNode applies the overrides given to a parsed YAML
+// document (e.g., a chart's values.yaml), in place, as for
+// ApplyOverrides. Since the document is edited rather than
+// regenerated, comments and the order of keys are kept; new keys are
+// added at the end of the mapping they belong to.
+func ApplyOverridesToNode(doc *yaml.Node, overrides map[string]interface{}) error {
+	node := doc
+	if node.Kind == yaml.DocumentNode {
+		if len(node.Content) == 0 {
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+		}
+		node = node.Content[0]
+	}
+	if node.Kind == 0 || node.Tag == "!!null" {
+		// e.g., an empty values.yaml
+		*node = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", HeadComment: node.HeadComment}
+	}
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("expected a mapping at line %d, but found something else", node.Line)
+	}
+
+	keys := make([]string, 0, len(overrides))
+	for k := range overrides {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		override := overrides[k]
+		i := indexOfKey(node, k)
+		if override == nil {
+			if i >= 0 {
+				node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			}
+			continue
+		}
+		if om, ok := override.(map[string]interface{}); ok && i >= 0 && node.Content[i+1].Kind == yaml.MappingNode {
+			if err := ApplyOverridesToNode(node.Content[i+1], om); err != nil {
+				return err
+			}
+			continue
+		}
+		value, err := EncodeNode(override)
+		if err != nil {
+			return fmt.Errorf("could not encode value for %q: %w", k, err)
+		}
+		if i >= 0 {
+			old := node.Content[i+1]
+			value.HeadComment, value.LineComment, value.FootComment = old.HeadComment, old.LineComment, old.FootComment
+			node.Content[i+1] = value
+			continue
+		}
+		key := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k}
+		node.Content = append(node.Content, key, value)
+	}
+	return nil
+}
+
+func indexOfKey(mapping *yaml.Node, key string) int {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return i
+		}
+	}
+	return -1
+}
+
+// EncodeNode encodes a value as a YAML node.
+func EncodeNode(v interface{}) (*yaml.Node, error) {
+	bs, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return nil, err
+	}
+	return doc.Content[0], nil
+}
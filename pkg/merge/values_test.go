@@ -0,0 +1,166 @@
+package merge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func parseValues(t *testing.T, src string) map[string]interface{} {
+	var values map[string]interface{}
+	assert.NoError(t, yaml.Unmarshal([]byte(src), &values))
+	return values
+}
+
+func TestMergeValues(t *testing.T) {
+	orig := parseValues(t, `
+replicas: 1
+image:
+  repository: app
+  tag: v1
+  pullPolicy: IfNotPresent
+service:
+  port: 80
+legacy: true
+oldOption: foo
+`)
+	yours := parseValues(t, `
+replicas: 1
+image:
+  repository: app
+  tag: v2
+  pullPolicy: Always
+service:
+  port: 8080
+newOption: bar
+`)
+	mine := parseValues(t, `
+replicas: 3
+image:
+  repository: app
+  pullPolicy: Never
+service:
+  port: 80
+legacy: false
+oldOption: foo
+`)
+	expected := parseValues(t, `
+replicas: 3
+image:
+  repository: app
+  pullPolicy: Never
+service:
+  port: 8080
+legacy: false
+newOption: bar
+`)
+
+	merged, changes := MergeValues(mine, orig, yours)
+	assert.Equal(t, expected, merged)
+	if assert.Len(t, changes, 4) {
+		assert.Equal(t, "image.pullPolicy", changes[0].Path)
+		assert.Equal(t, ValueConflictChangedInBoth, changes[0].Class)
+		// a value removed locally is not shown as a local null
+		assert.Equal(t, "image.tag", changes[1].Path)
+		assert.Equal(t, ValueConflictRemovedLocally, changes[1].Class)
+		assert.Equal(t, `image.tag: default changed upstream, but removed locally; keeping it removed (was "v1", now "v2")`, changes[1].String())
+		assert.Equal(t, "legacy", changes[2].Path)
+		assert.Equal(t, ValueConflictRemovedUpstream, changes[2].Class)
+		assert.Equal(t, "oldOption", changes[3].Path)
+		assert.Equal(t, ValueRemoved, changes[3].Class)
+		assert.False(t, changes[3].IsConflict())
+	}
+}
+
+func TestMergeValuesNumbers(t *testing.T) {
+	// a number decoded as a float on one side and an int on the
+	// other is still the same value
+	orig := map[string]interface{}{"replicas": float64(1)}
+	yours := map[string]interface{}{"replicas": float64(2)}
+	mine := map[string]interface{}{"replicas": 1}
+	merged, changes := MergeValues(mine, orig, yours)
+	assert.Empty(t, changes)
+	assert.Equal(t, map[string]interface{}{"replicas": float64(2)}, merged)
+}
+
+func TestOverrides(t *testing.T) {
+	defaults := parseValues(t, `
+replicas: 1
+image:
+  repository: app
+  tag: v1
+service:
+  port: 80
+  annotations: {}
+`)
+	values := parseValues(t, `
+replicas: 3
+image:
+  repository: app
+  tag: v1
+service:
+  annotations: {}
+extra: true
+`)
+	overrides := Overrides(values, defaults)
+	assert.Equal(t, parseValues(t, `
+replicas: 3
+service:
+  port: null
+extra: true
+`), overrides)
+
+	assert.Equal(t, values, ApplyOverrides(defaults, overrides))
+	// .. and the defaults are untouched
+	assert.Equal(t, 80, defaults["service"].(map[string]interface{})["port"])
+
+	assert.Empty(t, Overrides(defaults, defaults))
+	assert.Equal(t, defaults, ApplyOverrides(defaults, nil))
+}
+
+func TestApplyOverridesToNode(t *testing.T) {
+	const valuesFile = `# How many replicas to run
+replicas: 1
+
+image:
+  # The image repository
+  repository: app
+  tag: v1 # usually the app version
+
+# Service settings
+service:
+  port: 80
+  type: ClusterIP
+`
+	var doc yaml.Node
+	assert.NoError(t, yaml.Unmarshal([]byte(valuesFile), &doc))
+	assert.NoError(t, ApplyOverridesToNode(&doc, map[string]interface{}{
+		"replicas": 3,
+		"image":    map[string]interface{}{"tag": "v2"},
+		"service":  map[string]interface{}{"type": nil},
+		"extra":    []interface{}{"a", "b"},
+	}))
+	out, err := yaml.Marshal(&doc)
+	assert.NoError(t, err)
+	assert.Equal(t, `# How many replicas to run
+replicas: 3
+image:
+    # The image repository
+    repository: app
+    tag: v2 # usually the app version
+# Service settings
+service:
+    port: 80
+extra:
+  - a
+  - b
+`, string(out))
+
+	var empty yaml.Node
+	assert.NoError(t, yaml.Unmarshal([]byte("# nothing here\n"), &empty))
+	assert.NoError(t, ApplyOverridesToNode(&empty, map[string]interface{}{"replicas": 3}))
+	out, err = yaml.Marshal(&empty)
+	assert.NoError(t, err)
+	assert.Contains(t, string(out), "replicas: 3")
+}
@@ -13,6 +13,14 @@ func (s *Spec) Config() interface{} {
 		return s.Helm
 	case ImageKind:
 		return s.Image
+	case ExecKind, StarlarkKind:
+		return s.Function
+	case KustomizeKind:
+		return s.Kustomize
+	case GitKind:
+		// there's nothing to configure for git; the files are used
+		// as they are.
+		return nil
 	default: // TODO: other kinds
 		return nil
 	}
@@ -28,6 +36,14 @@ func (s *Spec) ReadConfig(reader io.Reader) error {
 	case ImageKind:
 		s.Image = &ImageArgs{}
 		return yaml.NewDecoder(reader).Decode(s.Image)
+	case ExecKind, StarlarkKind:
+		s.Function = &FunctionArgs{}
+		return yaml.NewDecoder(reader).Decode(s.Function)
+	case KustomizeKind:
+		s.Kustomize = &KustomizeArgs{}
+		return yaml.NewDecoder(reader).Decode(s.Kustomize)
+	case GitKind:
+		return nil
 	default: // TODO: other kinds
 		return nil
 	}
@@ -0,0 +1,89 @@
+package spec
+
+// Lock records exactly what a spec was evaluated with, so that
+// evaluating it again gives the same result even if (for example) an
+// image tag is pushed again or a chart archive is republished.
+type Lock struct {
+	APIVersion string `json:"apiVersion" yaml:"apiVersion"`
+	Kind       string `json:"kind" yaml:"kind"`
+
+	// the source and version from the spec, so it's possible to tell
+	// if the lock is out of date with respect to the spec
+	Source  string `json:"source" yaml:"source"`
+	Version string `json:"version" yaml:"version"`
+
+	// the content digest of what was evaluated: the image digest, the
+	// SHA-256 of the chart archive, or the git commit
+	Digest string `json:"digest" yaml:"digest"`
+
+	// for charts, the dependencies that were resolved from
+	// repositories
+	// +optional
+	Dependencies []DependencyLock `json:"dependencies,omitempty" yaml:"dependencies,omitempty"`
+
+	// the locks for the functions run in the spec's pipeline
+	// +optional
+	Pipeline []Lock `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
+}
+
+const LockKind = "SpresmLock"
+
+// NewLock creates a lock for the spec given, evaluated with the
+// digest given.
+func NewLock(s Spec, digest string) *Lock {
+	return &Lock{
+		APIVersion: APIVersion,
+		Kind:       LockKind,
+		Source:     s.Source,
+		Version:    s.Version,
+		Digest:     digest,
+	}
+}
+
+// AppliesTo says whether the lock was made for the source and version
+// in the spec given. If the spec has been changed since, the lock
+// does not apply.
+func (l *Lock) AppliesTo(s Spec) bool {
+	return l != nil && l.Source == s.Source && l.Version == s.Version
+}
+
+// DependencyLock records a chart dependency that was resolved when
+// evaluating a chart, i.e., one not bundled with the chart.
+type DependencyLock struct {
+	// the name of the dependency; for dependencies of dependencies,
+	// this is the path through the charts, e.g., "redis/common"
+	Name       string `json:"name" yaml:"name"`
+	Repository string `json:"repository" yaml:"repository"`
+	// the exact version the dependency was resolved to
+	Version string `json:"version" yaml:"version"`
+	Digest  string `json:"digest" yaml:"digest"`
+}
+
+// Dependency finds the locked dependency with the name and repository
+// given, or returns nil if there isn't one.
+func (l *Lock) Dependency(name, repository string) *DependencyLock {
+	if l == nil {
+		return nil
+	}
+	for i := range l.Dependencies {
+		if l.Dependencies[i].Name == name && l.Dependencies[i].Repository == repository {
+			return &l.Dependencies[i]
+		}
+	}
+	return nil
+}
+
+// PipelineLock finds the lock for a function in the pipeline, i.e.,
+// one that applies to the function spec given, or returns nil if
+// there isn't one.
+func (l *Lock) PipelineLock(fn Spec) *Lock {
+	if l == nil {
+		return nil
+	}
+	for i := range l.Pipeline {
+		if l.Pipeline[i].AppliesTo(fn) {
+			return &l.Pipeline[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package spec
+
+import (
+	"path"
+)
+
+// Step is a transformation in a spec's pipeline. Exactly one field
+// should be set.
+type Step struct {
+	// set the namespace of all namespaced resources
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+	// add labels to all resources (to their metadata only; selectors
+	// are left alone)
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	// add annotations to all resources
+	Annotations map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	// change the images used by containers
+	Images []ImageOverride `json:"images,omitempty" yaml:"images,omitempty"`
+	// apply strategic merge patches, each from a file in the package
+	// directory; each resource in a file patches the resource with
+	// the same kind and name (and namespace, if given)
+	Patches []string `json:"patches,omitempty" yaml:"patches,omitempty"`
+	// apply JSON (RFC 6902) patches to the resources selected
+	JSONPatches []JSONPatch `json:"jsonPatches,omitempty" yaml:"jsonPatches,omitempty"`
+	// run a function, of the kind Image, Exec or Starlark, with the
+	// resources as its input items
+	Function *Spec `json:"function,omitempty" yaml:"function,omitempty"`
+}
+
+// ImageOverride changes the image used by containers, as in a
+// kustomization.
+type ImageOverride struct {
+	// the image to change, without tag or digest, e.g., "nginx"
+	Name string `json:"name" yaml:"name"`
+	// a replacement for the name
+	// +optional
+	NewName string `json:"newName,omitempty" yaml:"newName,omitempty"`
+	// a replacement for the tag
+	// +optional
+	NewTag string `json:"newTag,omitempty" yaml:"newTag,omitempty"`
+	// a digest to use instead of the tag
+	// +optional
+	Digest string `json:"digest,omitempty" yaml:"digest,omitempty"`
+}
+
+// JSONPatch is a JSON patch to apply to the resource selected by the
+// target.
+type JSONPatch struct {
+	Target Target `json:"target" yaml:"target"`
+	// the file containing the patch, in the package directory; it can
+	// be YAML or JSON
+	Path string `json:"path" yaml:"path"`
+}
+
+// Target selects a resource by kind and name, and namespace if given.
+type Target struct {
+	Kind      string `json:"kind" yaml:"kind"`
+	Name      string `json:"name" yaml:"name"`
+	Namespace string `json:"namespace,omitempty" yaml:"namespace,omitempty"`
+}
+
+// PipelineFiles gives the paths of the files, in the package
+// directory, that the pipeline uses. These are not resources of the
+// package.
+func (s Spec) PipelineFiles() []string {
+	var files []string
+	for _, step := range s.Pipeline {
+		for _, p := range step.Patches {
+			files = append(files, path.Clean(p))
+		}
+		for _, p := range step.JSONPatches {
+			files = append(files, path.Clean(p.Path))
+		}
+	}
+	return files
+}
+
+// Transformations gives the names of the transformations given in the
+// step, as they appear in the Spresmfile. A step is expected to have
+// exactly one.
+func (s Step) Transformations() []string {
+	var names []string
+	for _, t := range []struct {
+		name string
+		set  bool
+	}{
+		{"namespace", s.Namespace != ""},
+		{"labels", s.Labels != nil},
+		{"annotations", s.Annotations != nil},
+		{"images", s.Images != nil},
+		{"patches", s.Patches != nil},
+		{"jsonPatches", s.JSONPatches != nil},
+		{"function", s.Function != nil},
+	} {
+		if t.set {
+			names = append(names, t.name)
+		}
+	}
+	return names
+}
@@ -7,15 +7,25 @@ type Spec struct {
 	APIVersion string `json:"apiVersion" yaml:"apiVersion"`
 	Kind       Kind   `json:"kind" yaml:"kind"`
 
-	// the upstream source; might be an image repository, or a git URL
+	// the upstream source; might be an image repository, a chart
+	// URL, or a git URL with the path to the files appended after
+	// `//` (e.g., https://github.com/org/app.git//config)
 	Source string `json:"source" yaml:"source"`
 	// the version of the source that's to be evaluated
 	Version string `json:"version" yaml:"version"`
 
 	// kind-specific bits
 	// +optional
-	Helm  *HelmArgs  `json:"helm,omitempty" yaml:"helm,omitempty"`
-	Image *ImageArgs `json:"image,omitempty" yaml:"image,omitempty"`
+	Helm      *HelmArgs      `json:"helm,omitempty" yaml:"helm,omitempty"`
+	Image     *ImageArgs     `json:"image,omitempty" yaml:"image,omitempty"`
+	Function  *FunctionArgs  `json:"function,omitempty" yaml:"function,omitempty"`
+	Kustomize *KustomizeArgs `json:"kustomize,omitempty" yaml:"kustomize,omitempty"`
+
+	// transformations to apply, in order, to the output before it's
+	// written to the package, so that adaptations survive updates
+	// without needing to be merged
+	// +optional
+	Pipeline []Step `json:"pipeline,omitempty" yaml:"pipeline,omitempty"`
 }
 
 type Kind string
@@ -24,6 +34,12 @@ const (
 	ImageKind Kind = "Image"
 	ChartKind Kind = "HelmChart"
 	GitKind   Kind = "Git"
+	// run a local executable that reads and writes a ResourceList
+	ExecKind Kind = "Exec"
+	// run a Starlark script, in-process
+	StarlarkKind Kind = "Starlark"
+	// build a kustomization, in-process
+	KustomizeKind Kind = "Kustomize"
 )
 
 func (s *Spec) Init(k Kind) {
@@ -34,19 +50,164 @@ func (s *Spec) Init(k Kind) {
 		s.Helm = &HelmArgs{}
 	case ImageKind:
 		s.Image = &ImageArgs{}
-	default:
-		// git not supported yet
+	case GitKind:
+		// no further configuration; the files are used as they are
+	case ExecKind, StarlarkKind:
+		s.Function = &FunctionArgs{}
+	case KustomizeKind:
+		s.Kustomize = &KustomizeArgs{}
 	}
 }
 
 type HelmArgs struct {
+	// the name of the repository settings (e.g., credentials) to use
+	// from the user's config, when it's not enough to look them up by
+	// the repository URL
+	// +optional
+	Repository string `json:"repository,omitempty" yaml:"repository,omitempty"`
+
 	Release struct {
 		Name      string `json:"name"`
 		Namespace string `json:"namespace"`
 	} `json:"release"`
 	Values map[string]interface{} `json:"values"`
+
+	// the Kubernetes version to render the chart for, e.g., "1.19";
+	// the default comes from the user config, or else Helm
+	// +optional
+	KubeVersion string `json:"kubeVersion,omitempty" yaml:"kubeVersion,omitempty"`
+	// API versions to make available to the chart, in addition to the
+	// built-in versions and any from the user config; e.g.,
+	// "networking.k8s.io/v1/Ingress"
+	// +optional
+	APIVersions []string `json:"apiVersions,omitempty" yaml:"apiVersions,omitempty"`
+
+	// whether to include the CRDs from the chart's crds/ directory,
+	// as `helm install` would; the default is to include them
+	// +optional
+	IncludeCRDs *bool `json:"includeCRDs,omitempty" yaml:"includeCRDs,omitempty"`
+	// what to do with hook resources, by hook type (e.g.,
+	// "pre-install", "test"); "*" gives the policy for types not
+	// otherwise mentioned. By default, install hooks are included,
+	// and other hooks are excluded, as for `helm install`.
+	// +optional
+	Hooks map[string]HookPolicy `json:"hooks,omitempty" yaml:"hooks,omitempty"`
 }
 
+// HookPolicy says what to do with Helm hook resources.
+type HookPolicy string
+
+const (
+	// include hook resources in the output
+	HookInclude HookPolicy = "include"
+	// leave hook resources out of the output
+	HookExclude HookPolicy = "exclude"
+	// include hook resources, but annotate them as local config, so
+	// they are not applied to the cluster
+	HookAnnotate HookPolicy = "annotate"
+)
+
 type ImageArgs struct {
 	FunctionConfig interface{} `json:"functionConfig" yaml:"functionConfig"`
+	// what to give the image as the items of its input; the default
+	// is none, i.e., the image generates resources from its
+	// functionConfig alone
+	// +optional
+	Items ImageItems `json:"items,omitempty" yaml:"items,omitempty"`
+
+	// The remaining fields loosen (or tighten) the sandbox the image
+	// is run in. By default it has no network, a read-only root
+	// filesystem, runs as an unprivileged user, and is limited in
+	// CPU, memory and time.
+
+	// the network for the container, e.g., "bridge" to let it
+	// connect out; the default is "none"
+	// +optional
+	Network string `json:"network,omitempty" yaml:"network,omitempty"`
+	// whether the container's root filesystem is read-only (/tmp is
+	// writable regardless); the default is read-only
+	// +optional
+	ReadOnlyRootFilesystem *bool `json:"readOnlyRootFilesystem,omitempty" yaml:"readOnlyRootFilesystem,omitempty"`
+	// the user to run as, as "uid" or "uid:gid"; the default is
+	// "65534:65534", i.e., nobody
+	// +optional
+	User string `json:"user,omitempty" yaml:"user,omitempty"`
+	// the number of CPUs the container can use, e.g., "0.5"; the
+	// default is "1"
+	// +optional
+	CPUs string `json:"cpus,omitempty" yaml:"cpus,omitempty"`
+	// the memory limit for the container, e.g., "1g"; the default is
+	// "512m"
+	// +optional
+	Memory string `json:"memory,omitempty" yaml:"memory,omitempty"`
+	// how long to let the image run before it is stopped, e.g.,
+	// "5m"; the default is "2m"
+	// +optional
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
+}
+
+// FunctionArgs are the arguments for the kinds "Exec" and "Starlark",
+// which run a function without a container engine. The source is the
+// path of the executable (relative to the package directory, or found
+// on $PATH if it's a bare name) or script (which may also be an HTTP
+// URL), and the version is optional.
+type FunctionArgs struct {
+	FunctionConfig interface{} `json:"functionConfig" yaml:"functionConfig"`
+	// what to give the function as the items of its input; as for
+	// images, the default is none
+	// +optional
+	Items ImageItems `json:"items,omitempty" yaml:"items,omitempty"`
+	// arguments for the executable
+	// +optional
+	Args []string `json:"args,omitempty" yaml:"args,omitempty"`
+	// how long to let the executable or script run before giving up
+	// on it; the default is "2m". An executable is stopped, along with
+	// anything it started; a Starlark script can't be stopped, so it's
+	// left to finish in the background.
+	// +optional
+	Timeout string `json:"timeout,omitempty" yaml:"timeout,omitempty"`
 }
+
+// KustomizeArgs are the arguments for the kind "Kustomize". The
+// source is the directory containing the kustomization, either a
+// local path (relative to the package directory) or a git URL with
+// the path appended after `//`; for a git URL, the version is the
+// tag, branch or commit to use.
+type KustomizeArgs struct {
+	// which files the kustomization may refer to: "rootOnly" (the
+	// default) means only those in or under its own directory, and
+	// "none" means any
+	// +optional
+	LoadRestrictor LoadRestrictor `json:"loadRestrictor,omitempty" yaml:"loadRestrictor,omitempty"`
+	// whether to enable kustomize's plugins, including the exec
+	// plugins it uses to inflate Helm charts; the default is to
+	// allow only the builtin generators and transformers
+	// +optional
+	EnablePlugins bool `json:"enablePlugins,omitempty" yaml:"enablePlugins,omitempty"`
+	// whether to add the label app.kubernetes.io/managed-by to the
+	// resources built
+	// +optional
+	AddManagedByLabel bool `json:"addManagedByLabel,omitempty" yaml:"addManagedByLabel,omitempty"`
+}
+
+// LoadRestrictor says which files a kustomization may refer to.
+type LoadRestrictor string
+
+const (
+	// only files in or under the kustomization's directory
+	LoadRestrictorRootOnly LoadRestrictor = "rootOnly"
+	// any files
+	LoadRestrictorNone LoadRestrictor = "none"
+)
+
+// ImageItems says what to give an image as the items of its input
+// ResourceList.
+type ImageItems string
+
+const (
+	// give no items, so the image acts as a generator
+	ImageItemsNone ImageItems = "none"
+	// give the resources in the package directory, so the image can
+	// transform or validate them
+	ImageItemsPackage ImageItems = "package"
+)